@@ -0,0 +1,90 @@
+package gtime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+var gstddev time.Duration // standard deviation of the last SyncAvg
+
+// SyncAvg is like Sync but fetches the time from Google servers multiple
+// times, back-to-back, and uses the mean offset of all samples. Samples that
+// disagree with the median offset by more than their uncertainty are
+// discarded, and an error is returned if none of the samples agree with the
+// median. Averaging reduces the jitter of noisy networks, such as mobile
+// and satellite links. Use LastStdDev to get how noisy the samples were.
+func SyncAvg(samples int, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, stddev, err := getAvg(ctx, &Config{Host: getHost()}, samples)
+	if err = commit(s, err); err == nil {
+		gmu.Lock()
+		gstddev = stddev
+		gmu.Unlock()
+	}
+	return err
+}
+
+// LastStdDev returns the standard deviation of the offsets that were used by
+// the last successful SyncAvg. Returns zero if SyncAvg never succeeded.
+func LastStdDev() time.Duration {
+	gmu.RLock()
+	defer gmu.RUnlock()
+	return gstddev
+}
+
+// getAvg fetches multiple samples from the server and returns a sample that
+// has the mean offset of the samples along with the standard deviation.
+func getAvg(ctx context.Context, cfg *Config, samples int,
+) (sample, time.Duration, error) {
+	if samples < 1 {
+		samples = 1
+	}
+	c := &keepAliveConn{ctx: ctx, cfg: cfg}
+	defer c.Close()
+	all := make([]sample, 0, samples)
+	for i := 0; i < samples; i++ {
+		s, err := c.fetch()
+		if err != nil {
+			return sample{}, 0, err
+		}
+		all = append(all, s)
+	}
+	sorted := append([]sample(nil), all...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].offset() < sorted[j].offset()
+	})
+	median := sorted[len(sorted)/2].offset()
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1].offset() + median) / 2
+	}
+	var kept []time.Duration
+	for _, s := range all {
+		if s.agrees(median) {
+			kept = append(kept, s.offset())
+		}
+	}
+	if len(kept) == 0 {
+		return sample{}, 0, fmt.Errorf("no agreement: none of the offsets "+
+			"of the %d samples agree with the median", len(all))
+	}
+	var sum float64
+	for _, offset := range kept {
+		sum += float64(offset)
+	}
+	mean := sum / float64(len(kept))
+	var vsum float64
+	for _, offset := range kept {
+		vsum += (float64(offset) - mean) * (float64(offset) - mean)
+	}
+	stddev := time.Duration(math.Sqrt(vsum / float64(len(kept))))
+	s := all[len(all)-1]
+	s.t = s.local.Add(time.Duration(mean))
+	return s, stddev, nil
+}
@@ -0,0 +1,62 @@
+package gtime
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time. It allows for injecting the time source
+// into code that depends on it, and for swapping it out in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// GTimeClock is a Clock that returns the Google time, see Now.
+type GTimeClock struct{}
+
+// Now returns the current Google time.
+func (GTimeClock) Now() time.Time {
+	return Now()
+}
+
+// SystemClock is a Clock that returns the local system time.
+type SystemClock struct{}
+
+// Now returns the current local system time.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock that returns a time that only changes when it's set
+// or advanced. It's intended for testing. The zero value is a clock that is
+// frozen at the zero time.
+type FakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewFakeClock returns a FakeClock that is frozen at t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Set sets the current time of the clock.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.t = t
+	c.mu.Unlock()
+}
+
+// Advance moves the current time of the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
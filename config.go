@@ -0,0 +1,178 @@
+package gtime
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config is used to customize how the time is fetched by SyncConfig.
+// The zero value fetches the time from Google over HTTP, same as Sync.
+type Config struct {
+	// Host is the "host:port" of the server. The server must respond to a
+	// HEAD request with a valid Date header. Defaults to "google.com:80", or
+	// "google.com:443" when TLSConfig is provided.
+	Host string
+	// Network is the network used to connect to the host, which must be
+	// "tcp", "tcp4" (IPv4-only), or "tcp6" (IPv6-only). Defaults to "tcp".
+	Network string
+	// TLSConfig enables HTTPS when provided.
+	TLSConfig *tls.Config
+	// DialContext is used to connect to the host. This allows for binding to
+	// a specific local address, setting keepalives, or using a proxy.
+	// Defaults to the DialContext method of a zero net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Method is the request method. Defaults to "HEAD", or "GET" when Parser
+	// is provided.
+	Method string
+	// Path is the request path. Defaults to "/", which is valid for all
+	// servers. A path of "-" is invalid and used to get a quick 404 from
+	// Google, likely from the proxy level rather than an application server,
+	// but relies on how Google handles the error.
+	Path string
+	// Header contains extra request header fields. The Host header defaults
+	// to the host, excluding the default ports.
+	Header http.Header
+	// Proxy returns the URL of the HTTP proxy to use for the target, which
+	// is either "http://host:port" or "https://host:port". When the returned
+	// URL is not nil, then the connection to the host is tunneled through the
+	// proxy using the CONNECT method. Use ProxyFromEnvironment for the
+	// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables, or
+	// ProxyURL for a fixed proxy. Defaults to no proxy.
+	Proxy func(target *url.URL) (*url.URL, error)
+	// DialTimeout is the maximum amount of time that connecting to the host
+	// may take, such as when name resolution is slow. Defaults to no limit
+	// other than the timeout of the sync.
+	DialTimeout time.Duration
+	// ReadTimeout is the maximum amount of time that sending a request and
+	// reading the response may take. Defaults to no limit other than the
+	// timeout of the sync.
+	ReadTimeout time.Duration
+	// StallTimeout is the maximum amount of time that each read of the
+	// response may take, which guards against a server that sends the
+	// response very slowly or stops sending it. The size of the response
+	// header is always limited to 8KB. Defaults to no limit other than
+	// ReadTimeout and the timeout of the sync.
+	StallTimeout time.Duration
+	// DNSCacheTTL is how long the address that the host resolved to is
+	// reused after a successful sync. The cached address is dialed directly,
+	// while the Host header and TLS server name remain the same, and the
+	// host is resolved again if the address stops working. Defaults to
+	// resolving the host for every sync.
+	DNSCacheTTL time.Duration
+	// Parser parses the time from the body of the response instead of the
+	// Date header, such as a JSONParser for a JSON time API. The time is
+	// assumed to be truncated to the second when it has no fraction of a
+	// second. Defaults to using the Date header.
+	Parser Parser
+}
+
+// SyncConfig is like Sync but uses the provided config.
+func SyncConfig(cfg Config, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return syncConfig(ctx, &cfg)
+}
+
+// host returns the "host:port" of the server.
+func (cfg *Config) host() string {
+	port := "80"
+	if cfg.TLSConfig != nil {
+		port = "443"
+	}
+	if cfg.Host == "" {
+		return "google.com:" + port
+	}
+	return hostPort(cfg.Host, port)
+}
+
+// network returns the network used to connect to the server.
+func (cfg *Config) network() string {
+	if cfg.Network == "" {
+		return "tcp"
+	}
+	return cfg.Network
+}
+
+// request returns the HTTP/1.1 request that is sent to the server. A
+// keep-alive request asks the server to keep the connection open for more
+// requests, otherwise the server is asked to close the connection.
+func (cfg *Config) request(keepAlive bool) string {
+	var sb strings.Builder
+	sb.WriteString(cfg.requestLine() + " HTTP/1.1\r\n")
+	// the Host header is required for HTTP/1.1, and some proxies and load
+	// balancers reject requests that are without it.
+	if cfg.Header.Get("Host") == "" {
+		sb.WriteString("Host: " + hostHeader(cfg.host()) + "\r\n")
+	}
+	if cfg.Header.Get("Connection") == "" {
+		if keepAlive {
+			sb.WriteString("Connection: keep-alive\r\n")
+		} else {
+			sb.WriteString("Connection: close\r\n")
+		}
+	}
+	cfg.Header.Write(&sb)
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// legacyRequest returns the HTTP/1.0 request that is sent to servers that
+// fail the HTTP/1.1 request.
+func (cfg *Config) legacyRequest() string {
+	var sb strings.Builder
+	sb.WriteString(cfg.requestLine() + " HTTP/1.0\r\n")
+	cfg.Header.Write(&sb)
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// requestLine returns the method and path of the request.
+func (cfg *Config) requestLine() string {
+	method, path := cfg.Method, cfg.Path
+	if method == "" {
+		method = "HEAD"
+		if cfg.Parser != nil {
+			method = "GET"
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+	return method + " " + path
+}
+
+// hostHeader returns the value of the Host header for the "host:port",
+// which excludes the default HTTP and HTTPS ports.
+func hostHeader(host string) string {
+	if h, port, err := net.SplitHostPort(host); err == nil &&
+		(port == "80" || port == "443") {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return host
+}
+
+// dial connects to the server.
+func (cfg *Config) dial(ctx context.Context, network, addr string,
+) (net.Conn, error) {
+	if cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.DialTimeout)
+		defer cancel()
+	}
+	if cfg.DialContext != nil {
+		return cfg.DialContext(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
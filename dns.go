@@ -0,0 +1,60 @@
+package gtime
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsEntry is the address that a host resolved to during a successful sync.
+type dnsEntry struct {
+	addr    string    // "ip:port" of the server
+	expires time.Time // when the address must be resolved again
+}
+
+var (
+	gdnsMu sync.Mutex
+	gdns   map[string]dnsEntry
+)
+
+// cachedAddr returns the cached address for the "host:port", if any.
+func cachedAddr(host string) (string, bool) {
+	gdnsMu.Lock()
+	defer gdnsMu.Unlock()
+	e, ok := gdns[host]
+	if !ok {
+		return "", false
+	}
+	if !time.Now().Before(e.expires) {
+		delete(gdns, host)
+		return "", false
+	}
+	return e.addr, true
+}
+
+// cacheAddr caches the address of the connection for the "host:port". The
+// host is not cached when it's already an IP address.
+func cacheAddr(host string, remote net.Addr, ttl time.Duration) {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil || net.ParseIP(h) != nil || remote == nil {
+		return
+	}
+	ip, port, err := net.SplitHostPort(remote.String())
+	if err != nil || net.ParseIP(ip) == nil {
+		return
+	}
+	gdnsMu.Lock()
+	defer gdnsMu.Unlock()
+	if gdns == nil {
+		gdns = make(map[string]dnsEntry)
+	}
+	gdns[host] = dnsEntry{addr: net.JoinHostPort(ip, port),
+		expires: time.Now().Add(ttl)}
+}
+
+// uncacheAddr removes the cached address for the "host:port".
+func uncacheAddr(host string) {
+	gdnsMu.Lock()
+	defer gdnsMu.Unlock()
+	delete(gdns, host)
+}
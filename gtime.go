@@ -4,114 +4,1197 @@
 package gtime
 
 import (
-	"io"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	_ "unsafe"
 )
 
-//go:linkname nanotime runtime.nanotime
-func nanotime() time.Duration
+// nanotime returns the current reading of the monotonic clock. It's a
+// variable to allow for simulating the passage of time in tests.
+var nanotime = runtimeNano
+
+// maxHeaderSize is the maximum size of an HTTP response header.
+const maxHeaderSize = 8 << 10
+
+// maxBodySize is the maximum size of an HTTP response body, which is only
+// read when a Parser is used.
+const maxBodySize = 64 << 10
 
 var (
-	gmu   sync.RWMutex
-	gnano time.Duration
-	gtime time.Time
+	// ErrNotSynced is returned by NowErr when the time has not been synced.
+	ErrNotSynced = errors.New("time has not been synced")
+	// ErrNoDrift is returned by EstimateDrift when the time has not been
+	// synced at least twice, far enough apart.
+	ErrNoDrift = errors.New("time has not been synced twice")
+	// ErrMaxSkew is returned when the server time differs from the local
+	// system time by more than the maximum skew, see SetMaxSkew.
+	ErrMaxSkew = errors.New("server time exceeds the maximum skew")
+	// ErrNoDateHeader is returned when the response from an HTTP server does
+	// not include a Date header, which means the server cannot be used for
+	// syncing.
+	ErrNoDateHeader = errors.New("response has no date header")
+	// ErrBeforeFloor is returned by SyncWithFloor when the server time is
+	// earlier than the floor.
+	ErrBeforeFloor = errors.New("server time is before the floor")
+	// ErrStale is returned by NowErr when the last successful sync is older
+	// than the max age, see SetMaxAge.
+	ErrStale = errors.New("time sync is stale")
 )
 
+var (
+	gmu   sync.RWMutex // guards the package settings below
+	ghost string
+	gip   string // IP of the last successful SyncIPs
+
+	gminInterval = time.Second
+	gsynced      time.Time // time of the last successful sync of SyncContext
+	gcall        *syncCall // sync of SyncContext in progress, if any
+
+	glogf func(format string, args ...any)
+)
+
+// SyncError is returned when fetching the time from a server fails.
+type SyncError struct {
+	// Op is the operation that failed, which is one of "dial", "proxy",
+	// "handshake", "write", "read", or "parse".
+	Op string
+	// Host is the server that the time was fetched from.
+	Host string
+	// Elapsed is the time spent prior to failing.
+	Elapsed time.Duration
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *SyncError) Error() string {
+	return e.Op + " " + e.Host + ": " + e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// sample is a single time measurement taken from a server.
+type sample struct {
+	date  time.Time     // date reported by the server
+	t     time.Time     // server time
+	local time.Time     // local system time at the moment t was captured
+	nano  time.Duration // monotonic clock at the moment t was captured
+	rtt   time.Duration // round-trip time of the request
+	err   time.Duration // estimated maximum error of t
+
+	status int    // HTTP status code of the response, if any
+	addr   string // remote address of the connection, if any
+}
+
+// offset returns the difference between the server time and the local
+// system time.
+func (s sample) offset() time.Duration {
+	return s.t.Sub(s.local)
+}
+
 // Sync will sync the time with Google servers. If the operation was successful
 // then every following Now() call will return Google time.
 // Returns an error if time cannot be fetched or the timeout has been reached.
 func Sync(timeout time.Duration) error {
-	t, nano, err := getNow(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return SyncContext(ctx)
+}
+
+// GoogleTime fetches the current Google time once and returns it, without
+// syncing. The time returned by Now is not affected, which makes this useful
+// for tools that only need the time once. The host can be changed with
+// SetHost.
+func GoogleTime(timeout time.Duration) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := getNow(ctx, &Config{Host: getHost()})
 	if err != nil {
-		return err
+		return time.Time{}, err
+	}
+	return s.t.Add(nanotime() - s.nano), nil
+}
+
+// SetHost sets the "host:port" of the server that is used by Sync,
+// SyncContext, SyncPrecise, and all functions that depend on them. This
+// allows for failing over to another server at runtime. The server must
+// respond to a HEAD request with a valid Date header. An empty host restores
+// the default, which is "google.com:80".
+func SetHost(host string) {
+	gmu.Lock()
+	ghost = host
+	gsynced = time.Time{}
+	gmu.Unlock()
+}
+
+// getHost returns the host set by SetHost.
+func getHost() string {
+	gmu.RLock()
+	host := ghost
+	gmu.RUnlock()
+	return host
+}
+
+// SyncContext is like Sync but uses a context instead of a timeout. If the
+// context is canceled or its deadline is reached before a response has been
+// received, then the returned error wraps ctx.Err().
+//
+// Calling SyncContext again within the minimum interval of the previous
+// successful sync, see SetMinInterval, returns nil without fetching the time.
+// Calling it while another call is fetching the time waits for the result of
+// that call, and fetches the time itself when that call fails. This also
+// applies to the other functions that use SyncContext, such as Sync.
+func SyncContext(ctx context.Context) error {
+	return syncContext(ctx, true)
+}
+
+// syncContext is SyncContext, which returns nil without fetching the time
+// within the minimum interval when limit is true. The retries of MustSync
+// and SyncRetry are not limited.
+func syncContext(ctx context.Context, limit bool) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	for {
+		gmu.Lock()
+		if limit && gminInterval > 0 && !gsynced.IsZero() &&
+			time.Since(gsynced) < gminInterval {
+			gmu.Unlock()
+			return nil
+		}
+		if call := gcall; call != nil {
+			gmu.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return canceled(ctx, ctx.Err())
+			}
+			if call.err == nil {
+				return nil
+			}
+			continue
+		}
+		call := &syncCall{done: make(chan struct{})}
+		gcall = call
+		host := ghost
+		gmu.Unlock()
+		call.err = syncConfig(ctx, &Config{Host: host})
+		gmu.Lock()
+		if call.err == nil {
+			gsynced = time.Now()
+		}
+		gcall = nil
+		gmu.Unlock()
+		close(call.done)
+		return call.err
 	}
+}
+
+// syncCall is a sync made by SyncContext that is in progress. The error is
+// set before done is closed.
+type syncCall struct {
+	done chan struct{}
+	err  error
+}
+
+// SetMinInterval sets the minimum interval between a successful sync made by
+// SyncContext and the next one. This protects against accidentally hammering
+// the network and the server, such as by calling Sync for every request.
+// Failed syncs are not limited. Defaults to one second. Zero or less
+// disables the minimum.
+func SetMinInterval(interval time.Duration) {
 	gmu.Lock()
-	gtime, gnano = t, nano
+	gminInterval = interval
 	gmu.Unlock()
-	return nil
+}
+
+// SyncDeadline is like Sync but uses an absolute deadline instead of a
+// timeout.
+func SyncDeadline(deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return SyncContext(ctx)
+}
+
+// SyncWithFloor is like Sync but rejects a server time that is earlier than
+// the floor, such as the build time of the program, returning ErrBeforeFloor.
+// This protects against a rolled back time, which would make expired
+// certificates appear to be valid.
+func SyncWithFloor(floor time.Time, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := getNow(ctx, &Config{Host: getHost()})
+	if err == nil && s.t.Before(floor) {
+		err = fmt.Errorf("%w: %v is before %v", ErrBeforeFloor, s.t, floor)
+	}
+	return commit(s, err)
+}
+
+// SyncHost is like Sync but uses the provided host instead of Google. The
+// host must be in the "host:port" format, otherwise port 80 is used. The
+// server must respond to a HEAD request with a valid Date header.
+func SyncHost(host string, timeout time.Duration) error {
+	return SyncConfig(Config{Host: host}, timeout)
+}
+
+// SyncVia is like SyncHost but connects to the provided "host:port" address
+// while the request has the provided Host header, for servers that use
+// virtual hosting, such as when connecting to a pinned IP or a CDN edge. The
+// address uses port 80 when a port is not provided.
+func SyncVia(addr, hostHeader string, timeout time.Duration) error {
+	return SyncConfig(Config{Host: addr,
+		Header: http.Header{"Host": {hostHeader}}}, timeout)
+}
+
+// SyncIPs is like Sync but connects to the provided IP addresses instead of
+// resolving the host, trying each one in turn until one succeeds. An IP may
+// include a port, otherwise port 80 is used. The request still has the Host
+// header of the host, see SetHost, for servers that use virtual hosting. Use
+// LastIP to get the IP that succeeded.
+func SyncIPs(ips []string, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if len(ips) == 0 {
+		return commit(sample{}, errors.New("no ips provided"))
+	}
+	cfg := Config{Host: getHost()}
+	header := http.Header{"Host": {hostHeader(cfg.host())}}
+	var errs []error
+	for _, ip := range ips {
+		s, err := getNow(ctx, &Config{Host: hostPort(ip, "80"), Header: header})
+		if err == nil {
+			if err = commit(s, nil); err == nil {
+				gmu.Lock()
+				gip = ip
+				gmu.Unlock()
+			}
+			return err
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return commit(sample{}, errors.Join(errs...))
+}
+
+// LastIP returns the IP that succeeded for the last successful SyncIPs, or
+// an empty string when SyncIPs never succeeded.
+func LastIP() string {
+	gmu.RLock()
+	defer gmu.RUnlock()
+	return gip
+}
+
+// SyncTLS is like Sync but fetches the time from Google over HTTPS. This is
+// useful for networks that only allow outbound connections on port 443.
+func SyncTLS(timeout time.Duration) error {
+	return SyncTLSConfig(nil, timeout)
+}
+
+// SyncTLSConfig is like SyncTLS but uses the provided TLS configuration,
+// which allows for pinning certificates or using custom root authorities.
+// A nil config is the same as calling SyncTLS.
+func SyncTLSConfig(config *tls.Config, timeout time.Duration) error {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return SyncConfig(Config{Host: tlsHost, TLSConfig: config}, timeout)
+}
+
+// tlsHost is the "host:port" of the server that is used by SyncTLS. It's a
+// variable to allow for syncing with a local server in tests.
+var tlsHost = "google.com:443"
+
+// SyncPrecise is like Sync but it takes multiple samples from Google
+// servers in order to detect the moment that the Date header ticks over to
+// the next second. This provides sub-second precision, while Sync is only
+// accurate to about one second. Each sample is timed to land on the expected
+// tick, so the operation may take up to one second per sample.
+func SyncPrecise(samples int, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := getPrecise(ctx, &Config{Host: getHost()}, samples)
+	return commit(s, err)
+}
+
+// Measurement is a single time measurement taken from a server.
+type Measurement struct {
+	ServerTime  time.Time     // server time at the moment of capture
+	LocalTime   time.Time     // local system time at the moment of capture
+	RTT         time.Duration // round-trip time of the request
+	Offset      time.Duration // difference between ServerTime and LocalTime
+	Uncertainty time.Duration // estimated maximum error of ServerTime
+}
+
+// SyncInspect is like Sync but returns the measurement instead of storing
+// it. The time used by Now is not affected. This is useful for probing a
+// server, such as from a diagnostics tool.
+func SyncInspect(timeout time.Duration) (Measurement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := getNow(ctx, &Config{Host: getHost()})
+	if err != nil {
+		return Measurement{}, err
+	}
+	return Measurement{ServerTime: s.t, LocalTime: s.local, RTT: s.rtt,
+		Offset: s.offset(), Uncertainty: s.err}, nil
+}
+
+func syncConfig(ctx context.Context, cfg *Config) error {
+	s, err := getNow(ctx, cfg)
+	return commit(s, err)
+}
+
+// commit records the outcome of a sync using the default Syncer.
+func commit(s sample, err error) error {
+	return std.commit(s, err)
+}
+
+// SetMaxSkew sets the maximum difference between the server time and the
+// local system time that is allowed for a sync to succeed. Protects against
+// a broken or compromised server that reports a time that is far off.
+// A sync that exceeds the maximum returns ErrMaxSkew. Defaults to 24 hours.
+// Zero or less disables the check.
+func SetMaxSkew(max time.Duration) {
+	std.SetMaxSkew(max)
+}
+
+// SetValidator sets a function that decides whether the time of a sync is
+// plausible, which is called with the server time and the local system time
+// before the sync is committed. When the function returns an error, the sync
+// is rejected and returns the error. This allows for acceptance policies
+// beyond SetMaxSkew and SyncWithFloor. A nil function accepts all times,
+// which is the default.
+func SetValidator(fn func(serverTime, localTime time.Time) error) {
+	std.SetValidator(fn)
+}
+
+// SetMaxAge sets the maximum amount of time since the last successful sync
+// that the synced time may be used for. Once exceeded, NowErr returns
+// ErrStale and Now panics with ErrStale, see PanicOnUnsynced, until the time
+// is synced again. This avoids silently using a clock that has drifted, such
+// as when auto sync keeps failing. Zero or less disables the check, which
+// is the default.
+func SetMaxAge(max time.Duration) {
+	std.SetMaxAge(max)
+}
+
+// Reset clears the synced state, making it as if Sync or MustSync has never
+// been called. Settings, such as SetHost, and the counters returned by Stats
+// are not affected.
+func Reset() {
+	std.Reset()
+	gmu.Lock()
+	gsynced = time.Time{}
+	gip = ""
+	gstddev = 0
+	gmu.Unlock()
+}
+
+// OnSync registers a function that is called after every successful sync
+// with the new offset, see Offset, and the server time at the moment of the
+// sync. The function is called from the goroutine that performed the sync.
+func OnSync(fn func(offset time.Duration, serverTime time.Time)) {
+	std.OnSync(fn)
+}
+
+// OnStep registers a function that is called when a sync finds that the
+// offset changed by more than the step threshold, see SetStepThreshold,
+// since the previous sync. The delta is the new offset minus the previous
+// offset. A step is caused by a jump of the local system clock, such as
+// when a virtual machine resumes or when NTP steps the clock. The function
+// is called from the goroutine that performed the sync, prior to the OnSync
+// functions.
+func OnStep(fn func(delta time.Duration)) {
+	std.OnStep(fn)
+}
+
+// SetStepThreshold sets the change in offset between two syncs that is
+// considered a step, see OnStep. Defaults to two seconds, which is twice the
+// precision of the Date header.
+func SetStepThreshold(threshold time.Duration) {
+	std.SetStepThreshold(threshold)
+}
+
+// SyncNotify returns a channel that receives the server time of every
+// successful sync. Each call returns a new channel, and every channel
+// receives every sync. The channel buffers a single sync, a sync that occurs
+// while the buffer is full is dropped rather than blocking the sync.
+// Call the returned cancel function when the channel is no longer needed,
+// after which the channel receives no more syncs. The channel is not closed.
+func SyncNotify() (ch <-chan time.Time, cancel func()) {
+	gnotifyOnce.Do(func() { OnSync(notify) })
+	c := make(chan time.Time, 1)
+	gnotifyMu.Lock()
+	if gnotify == nil {
+		gnotify = make(map[chan time.Time]struct{})
+	}
+	gnotify[c] = struct{}{}
+	gnotifyMu.Unlock()
+	return c, func() {
+		gnotifyMu.Lock()
+		delete(gnotify, c)
+		gnotifyMu.Unlock()
+	}
+}
+
+var (
+	gnotifyOnce sync.Once
+	gnotifyMu   sync.Mutex
+	gnotify     map[chan time.Time]struct{} // channels of SyncNotify
+)
+
+// notify sends the server time to the channels of SyncNotify.
+func notify(_ time.Duration, serverTime time.Time) {
+	gnotifyMu.Lock()
+	defer gnotifyMu.Unlock()
+	for ch := range gnotify {
+		select {
+		case ch <- serverTime:
+		default:
+		}
+	}
 }
 
 // MustSync will attempt to sync with Google servers. It will try over and over
 // again until the timeout has been reached. It will panic if the timeout is
 // reached. If the operation was successful then every following Now() call
-// will return Google time.
+// will return Google time. The attempts are not limited by the minimum
+// interval, see SetMinInterval.
 func MustSync(timeout time.Duration) {
-	deadline := time.Now().Add(timeout)
-	for {
-		timeout := deadline.Sub(time.Now())
-		if err := Sync(timeout); err != nil {
-			if deadline.Sub(time.Now()) < 0 {
-				panic(err)
+	MustSyncEvery(defaultRetryInterval, timeout)
+}
+
+// MustSyncEvery is like MustSync but waits for the interval between
+// attempts, rather than 50 milliseconds. A longer interval is better for
+// links with a high latency, and a shorter one for fast local networks.
+func MustSyncEvery(interval, timeout time.Duration) {
+	if _, err := syncUntil(interval, timeout); err != nil {
+		panic(err)
+	}
+}
+
+// SyncResult describes the successful sync of MustSyncResult.
+type SyncResult struct {
+	Offset      time.Duration // offset measured by the sync
+	RTT         time.Duration // round-trip time of the request
+	Uncertainty time.Duration // estimated maximum error of the time
+	Attempts    int           // number of attempts, including the last one
+	Elapsed     time.Duration // time spent on all attempts
+}
+
+// MustSyncResult is like MustSync but returns a description of the sync,
+// which is useful for logging how long syncing took at startup and how
+// accurate the time is.
+func MustSyncResult(timeout time.Duration) SyncResult {
+	res, err := syncUntil(defaultRetryInterval, timeout)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// TrySync is like MustSync but returns false instead of panicking when the
+// timeout is reached.
+func TrySync(timeout time.Duration) bool {
+	_, err := syncUntil(defaultRetryInterval, timeout)
+	return err == nil
+}
+
+// defaultRetryInterval is the wait between the attempts of MustSync.
+const defaultRetryInterval = time.Millisecond * 50
+
+// syncUntil tries to sync over and over again, waiting for the interval
+// between attempts, until the timeout has been reached. Returns the last
+// error, without waiting for the interval beyond the timeout.
+func syncUntil(interval, timeout time.Duration) (SyncResult, error) {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for attempts := 1; ; attempts++ {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := syncContext(ctx, false)
+		cancel()
+		if err != nil {
+			// never wait past the deadline for an attempt that cannot be
+			// made.
+			wait := time.Until(deadline)
+			if wait > 0 {
+				time.Sleep(min(interval, wait))
+			}
+			if !time.Now().Before(deadline) {
+				return SyncResult{}, err
 			}
-			time.Sleep(time.Millisecond * 50)
 			continue
 		}
-		break
+		std.mu.RLock()
+		res := SyncResult{Offset: std.offset, RTT: std.rtt,
+			Uncertainty: std.err, Attempts: attempts,
+			Elapsed: time.Since(start)}
+		std.mu.RUnlock()
+		return res, nil
 	}
 }
 
+// SyncRetry will attempt to sync with Google servers up to the number of
+// attempts, or until the timeout has been reached. The wait between attempts
+// starts at backoff and doubles after each failed attempt. The attempts are
+// not limited by the minimum interval, see SetMinInterval.
+// Returns the error of the last attempt if all attempts fail.
+func SyncRetry(attempts int, backoff, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			tm := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				tm.Stop()
+				return err
+			case <-tm.C:
+			}
+			backoff *= 2
+		}
+		if err = syncContext(ctx, false); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// StartAutoSync starts a background routine that syncs with Google servers
+// at every interval. A failed sync keeps the time from the previous
+// successful sync. The returned stop function ends the routine and waits for
+// any pending sync to be canceled. Panics if the interval is not positive,
+// like time.NewTicker.
+func StartAutoSync(interval time.Duration) (stop func()) {
+	return StartAutoSyncOptions(interval, AutoSyncOptions{})
+}
+
+// AutoSyncOptions are the options for StartAutoSyncOptions.
+type AutoSyncOptions struct {
+	// Align schedules the syncs on multiples of the interval, using Google
+	// time when synced, such as every hour on the hour. This makes the syncs
+	// of multiple instances happen at predictable times.
+	Align bool
+	// Jitter is the maximum random delay that is added to each sync, which
+	// spreads the load of multiple instances on the server.
+	Jitter time.Duration
+}
+
+// StartAutoSyncOptions is like StartAutoSync but uses the provided options.
+func StartAutoSyncOptions(interval time.Duration, opts AutoSyncOptions,
+) (stop func()) {
+	return StartAutoSyncController(interval, opts).Stop
+}
+
+// AutoSync controls the background routine of StartAutoSyncController.
+type AutoSync struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	paused atomic.Bool
+}
+
+// StartAutoSyncController is like StartAutoSyncOptions but returns an
+// AutoSync, which allows for pausing and resuming the syncs, such as during
+// maintenance windows, in addition to stopping them.
+func StartAutoSyncController(interval time.Duration, opts AutoSyncOptions,
+) *AutoSync {
+	checkInterval(interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &AutoSync{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(a.done)
+		autoSync(ctx, interval, opts, &a.paused)
+	}()
+	return a
+}
+
+// Stop ends the routine and waits for any pending sync to be canceled.
+func (a *AutoSync) Stop() {
+	a.cancel()
+	<-a.done
+}
+
+// Pause skips the syncs until Resume is called, while the routine keeps
+// running. Now keeps using the time from the last successful sync. A sync
+// that is already in progress is not affected.
+func (a *AutoSync) Pause() {
+	a.paused.Store(true)
+}
+
+// Resume continues the syncs after Pause, starting at the next interval.
+func (a *AutoSync) Resume() {
+	a.paused.Store(false)
+}
+
+// Paused returns true if the syncs are paused.
+func (a *AutoSync) Paused() bool {
+	return a.paused.Load()
+}
+
+// StartAutoSyncContext is like StartAutoSync but the background routine runs
+// until the context is canceled, which allows for tying it to the lifetime
+// of the application.
+func StartAutoSyncContext(ctx context.Context, interval time.Duration) {
+	checkInterval(interval)
+	go autoSync(ctx, interval, AutoSyncOptions{}, nil)
+}
+
+// checkInterval panics if the interval of auto sync is not positive, which
+// would otherwise sync in a busy loop.
+func checkInterval(interval time.Duration) {
+	if interval <= 0 {
+		panic("gtime: non-positive interval for auto sync")
+	}
+}
+
+// autoSync syncs at every interval until the context is done, skipping the
+// syncs while paused, if provided. Each sync may take up to the interval.
+func autoSync(ctx context.Context, interval time.Duration,
+	opts AutoSyncOptions, paused *atomic.Bool) {
+	for {
+		tm := time.NewTimer(opts.wait(interval))
+		select {
+		case <-ctx.Done():
+			tm.Stop()
+			return
+		case <-tm.C:
+			if paused != nil && paused.Load() {
+				continue
+			}
+			tctx, tcancel := context.WithTimeout(ctx, interval)
+			SyncContext(tctx)
+			tcancel()
+		}
+	}
+}
+
+// wait returns the time to wait until the next sync.
+func (opts AutoSyncOptions) wait(interval time.Duration) time.Duration {
+	wait := interval
+	if opts.Align {
+		now := NowOr(time.Now())
+		wait = now.Truncate(interval).Add(interval).Sub(now)
+	}
+	if opts.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(opts.Jitter)))
+	}
+	return wait
+}
+
 // Now returns the current Google time.
-// Local system time is returned if Sync or MustSync has not been
-// succesfully called.
+// Panics if Sync or MustSync has not been succesfully called. The panic
+// value is ErrNotSynced, or ErrStale when the max age is exceeded, see
+// SetMaxAge, which allows for recovering from it, and panicking can be
+// turned off with PanicOnUnsynced.
+//
+// The returned time does not carry a monotonic clock reading, which means
+// that it's not affected by changes to the local system clock, but also that
+// subtracting two times uses the wall clock. Use NowMono for measuring
+// elapsed time.
 func Now() time.Time {
-	gmu.RLock()
-	t, nano := gtime, gnano
-	gmu.RUnlock()
-	if nano == 0 {
-		panic("time has not been synced")
-	}
-	return t.Add(time.Duration(nanotime() - nano))
+	return std.Now()
 }
 
-func getNow(timeout time.Duration) (
-	t time.Time, nano time.Duration, err error,
-) {
-	deadline := time.Now().Add(timeout)
-	// connect to public google.com on port 80. This should resolve globally
-	// keeping the hops down regardless of where in the world we are.
-	c, err := net.DialTimeout("tcp", "google.com:80", timeout)
+// PanicOnUnsynced turns on or off panicking when the time is requested from
+// Now, and the functions that depend on it, while not synced. When off, the
+// local system time is returned instead, allowing for migrating away from
+// the panic. Use NowErr, NowOr, or NowSource to know whether the time was
+// synced. On by default.
+func PanicOnUnsynced(enabled bool) {
+	std.PanicOnUnsynced(enabled)
+}
+
+// NowOr returns the current Google time, or the fallback time if Sync or
+// MustSync has not been succesfully called. Typically the fallback is the
+// local system time, such as gtime.NowOr(time.Now()).
+func NowOr(fallback time.Time) time.Time {
+	t, err := NowErr()
 	if err != nil {
-		return time.Time{}, 0, err
+		return fallback
 	}
-	defer c.Close()
-	err = c.SetWriteDeadline(deadline)
+	return t
+}
+
+// NowSource returns the current Google time and true, or the local system
+// time and false if Sync or MustSync has not been succesfully called or the
+// local system time is forced, see ForceLocal. This allows for tagging times
+// with whether they were synced.
+func NowSource() (time.Time, bool) {
+	t, local, err := std.nowAt(nanotime(), time.Now)
 	if err != nil {
-		return time.Time{}, 0, err
+		return time.Now(), false
 	}
-	// Using a dash a the resource path with a head ensures that a 404 is
-	// returned very quickly, which is what we want. It's likely that the
-	// request will fail at the proxy level instead of making it to an
-	// application server.
-	_, err = io.WriteString(c, "HEAD - HTTP/1.0\r\n\r\n")
+	return t, !local
+}
+
+// NowUTC returns the current Google time in UTC.
+// Panics if Sync or MustSync has not been succesfully called.
+func NowUTC() time.Time {
+	return Now().UTC()
+}
+
+// NowIn returns the current Google time in the provided location.
+// Panics if Sync or MustSync has not been succesfully called.
+func NowIn(loc *time.Location) time.Time {
+	return Now().In(loc)
+}
+
+// NowRounded returns the current Google time rounded to the nearest multiple
+// of d, such as for bucketing by the minute. The location of the time is
+// kept, see KeepUTC. Rounding is the same as time.Time.Round, which rounds
+// the time since the zero time, so it does not depend on the location.
+// Panics if Sync or MustSync has not been succesfully called.
+func NowRounded(d time.Duration) time.Time {
+	return Now().Round(d)
+}
+
+// NowBoth returns the current Google time and the local system time, which
+// are captured at the same instant. This is useful for monitoring the
+// difference between the two over time.
+// Panics if Sync or MustSync has not been succesfully called.
+func NowBoth() (google, local time.Time) {
+	return std.NowBoth()
+}
+
+// UnixNano returns the current Google time in nanoseconds since the Unix
+// epoch, like Now().UnixNano() but without computing the time.
+// Panics if Sync or MustSync has not been succesfully called.
+func UnixNano() int64 {
+	return std.UnixNano()
+}
+
+// Unix returns the current Google time in seconds since the Unix epoch.
+// Panics if Sync or MustSync has not been succesfully called.
+func Unix() int64 {
+	return std.Unix()
+}
+
+// NowErr returns the current Google time.
+// Returns ErrNotSynced if Sync or MustSync has not been succesfully called,
+// or ErrStale if the last successful sync exceeds the max age, see SetMaxAge.
+func NowErr() (time.Time, error) {
+	return std.NowErr()
+}
+
+// ForceLocal turns on or off using the local system time. When on, Now and
+// all functions that depend on it return the local system time regardless
+// of the synced time, and Sync and all other sync functions do nothing and
+// return nil. This is a kill switch for when the server is suspected to be
+// compromised. Turning it off restores the previously synced time, if any.
+// Off by default.
+func ForceLocal(local bool) {
+	std.ForceLocal(local)
+}
+
+// Monotonic turns on or off monotonic mode. When on, Now never returns a
+// time that is earlier than a time it previously returned, including across
+// syncs and from multiple goroutines. A sync that would move the time
+// backwards instead slews the time toward the new offset, see SmoothOffset,
+// while a sync that moves the time forward steps. This is useful for
+// generating increasing timestamps or IDs. Off by default.
+func Monotonic(mono bool) {
+	std.Monotonic(mono)
+}
+
+// SmoothOffset turns on or off slewing the time after a sync. When on, a
+// sync that changes the offset does not step the time returned by Now,
+// instead the time gradually moves toward the new offset at a rate of 500
+// parts per million, which is about 33 minutes for each second of change.
+// Now never goes backwards while slewing. The first sync always steps.
+// Off by default.
+//
+// This is recommended when syncing often, such as with StartAutoSync, as
+// the Date header only has a precision of one second. It also hides leap
+// seconds, which Google smears over 24 hours for NTP but not for the Date
+// header, from appearing as a jump in time.
+func SmoothOffset(smooth bool) {
+	std.SmoothOffset(smooth)
+}
+
+// SetSmoothing sets the weight, between zero and one, of the offset of a new
+// sync when combined with the previous offset as an exponentially weighted
+// moving average. A small weight damps the noise of jittery networks, while
+// still tracking the actual drift over multiple syncs. For example, 0.25
+// moves the offset a quarter of the way toward each new sync. Zero or one
+// turns off smoothing, which is the default.
+func SetSmoothing(alpha float64) {
+	std.SetSmoothing(alpha)
+}
+
+// KeepUTC turns on or off returning UTC times from Now and NowErr. HTTP
+// servers report the time in GMT, which by default is converted to the local
+// time zone. Off by default.
+func KeepUTC(keep bool) {
+	std.KeepUTC(keep)
+}
+
+// Since returns the time elapsed since t according to Google time. It's
+// shorthand for gtime.Now().Sub(t).
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// Until returns the duration until t according to Google time. It's
+// shorthand for t.Sub(gtime.Now()).
+func Until(t time.Time) time.Duration {
+	return t.Sub(Now())
+}
+
+// monoBase is the time that the monotonic clock readings of NowMono are
+// relative to.
+var monoBase = time.Now()
+
+// NowMono is like Now but returns the current Google time with a monotonic
+// clock reading. Subtracting two times returned by NowMono yields the elapsed
+// time without being affected by changes to the local system clock, like the
+// standard time package would. The time is always in the local time zone,
+// even when KeepUTC is enabled, because converting it would strip the
+// monotonic clock reading.
+// Panics if Sync or MustSync has not been succesfully called.
+func NowMono() time.Time {
+	nano, now := nanotime(), time.Now()
+	t, local, err := std.nowAt(nano, func() time.Time { return now })
 	if err != nil {
-		return time.Time{}, 0, err
+		return std.unsynced(err)
 	}
-	b := make([]byte, 128)
-	err = c.SetReadDeadline(deadline)
-	if err != nil {
-		return time.Time{}, 0, err
+	if local {
+		return now
 	}
-	n, err := c.Read(b)
-	if err != nil {
-		return time.Time{}, 0, err
-	}
-	// get out server clock prior to parsing the response. This value will
-	// be used as the seed to sync against for all following Now calls.
-	nano = nanotime()
-	var dts string
-	for _, line := range strings.Split(string(b[:n]), "\r\n") {
-		if strings.HasPrefix(line, "Date:") {
-			dts = strings.TrimSpace(line[5:])
-			break
+	// adding to monoBase moves both its wall and monotonic clock readings.
+	return monoBase.Add(t.Round(0).Sub(monoBase))
+}
+
+// WaitSynced blocks until the time has been synced, such as by StartAutoSync,
+// or until the timeout is reached. Returns nil right away when the time has
+// already been synced, and ErrNotSynced when the timeout is reached. This
+// allows for waiting on the first sync at startup without calling Now
+// before it succeeds.
+func WaitSynced(timeout time.Duration) error {
+	return std.WaitSynced(timeout)
+}
+
+// IsSynced returns true if Sync or MustSync has been succesfully called.
+func IsSynced() bool {
+	return std.IsSynced()
+}
+
+// Offset returns the difference between Google time and the local system
+// time as measured by the last successful Sync. A positive value means that
+// the local clock is behind Google time. Returns zero if time has not been
+// synced.
+func Offset() time.Duration {
+	return std.Offset()
+}
+
+// LocalAheadBy returns how far the local system clock is ahead of Google
+// time beyond the uncertainty, see Uncertainty, as measured by the last
+// successful Sync. Returns zero if the local clock is not known to be ahead,
+// or if time has not been synced. A local clock that runs ahead is the more
+// dangerous direction for checking expirations and tokens issued "in the
+// future".
+func LocalAheadBy() time.Duration {
+	std.mu.RLock()
+	ahead := -std.offset - std.err
+	std.mu.RUnlock()
+	return max(ahead, 0)
+}
+
+// LastRTT returns the round-trip time of the request made by the last
+// successful Sync. Returns zero if time has not been synced.
+func LastRTT() time.Duration {
+	return std.LastRTT()
+}
+
+// getPrecise takes multiple samples from the server and returns a sample that
+// has sub-second precision.
+//
+// The Date header is only accurate to the second, so each sample tells us
+// that the server time at the moment the Date was generated is somewhere
+// between Date and Date+1s. Expressed as an unknown offset k from the local
+// monotonic clock to the server time (relative to the first Date), each
+// sample narrows k down to a one second window. Intersecting the windows
+// of all samples yields k with an accuracy that is bounded by the round-trip
+// time. To make the windows intersect as tightly as possible, each sample is
+// timed to arrive at the server at the moment where the second is expected
+// to tick over, according to the current best estimate of k.
+func getPrecise(ctx context.Context, cfg *Config, samples int,
+) (sample, error) {
+	if samples < 1 {
+		samples = 1
+	}
+	// all samples are taken over a single keep-alive connection, when the
+	// server allows for it, which reduces the jitter between samples.
+	c := &keepAliveConn{ctx: ctx, cfg: cfg}
+	defer c.Close()
+	var first, s sample
+	var klo, khi time.Duration
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			// wait until the next expected tick, minus the time it takes
+			// for the request to reach the server.
+			kmid := klo + (khi-klo)/2
+			now := nanotime()
+			tick := (now+s.rtt/2+kmid)/time.Second*time.Second + time.Second
+			wait := tick - kmid - s.rtt/2 - now
+			tm := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				tm.Stop()
+				return sample{}, canceled(ctx, ctx.Err())
+			case <-tm.C:
+			}
+		}
+		var err error
+		if s, err = c.fetch(); err != nil {
+			return sample{}, err
+		}
+		if i == 0 {
+			first = s
+		}
+		// the date was generated somewhere between sending the request and
+		// receiving the response.
+		start, end := s.nano-s.rtt, s.nano
+		d := s.date.Sub(first.date)
+		lo, hi := d-end, d+time.Second-start
+		if i == 0 || lo >= khi || hi <= klo {
+			// first sample or the server disagrees with itself, possibly
+			// due to a clock step. Start over with this sample.
+			klo, khi = lo, hi
+			continue
+		}
+		if lo > klo {
+			klo = lo
+		}
+		if hi < khi {
+			khi = hi
 		}
 	}
-	t, err = time.Parse(time.RFC1123, dts)
-	if err != nil {
-		return time.Time{}, 0, err
+	kmid := klo + (khi-klo)/2
+	s.t = first.date.Add(s.nano + kmid)
+	s.err = (khi - klo) / 2
+	return s, nil
+}
+
+// LastSync returns the local system time of when the last successful Sync
+// completed. Returns false if time has not been synced.
+func LastSync() (time.Time, bool) {
+	return std.LastSync()
+}
+
+// NeedsSync returns true if the last successful Sync is older than maxAge,
+// or if time has not been synced.
+func NeedsSync(maxAge time.Duration) bool {
+	t, ok := std.LastSync()
+	return !ok || time.Since(t) > maxAge
+}
+
+// Healthy returns true if the time is synced, the last successful Sync is
+// no older than maxAge, and the offset is no more than maxOffset in either
+// direction, along with a reason that describes the result. Zero or less
+// disables the check of maxAge or maxOffset. This is useful for readiness
+// probes.
+func Healthy(maxOffset, maxAge time.Duration) (bool, string) {
+	std.mu.RLock()
+	synced, last, offset := std.synced, std.last, std.offset
+	std.mu.RUnlock()
+	if !synced {
+		return false, "not synced"
+	}
+	age := time.Since(last)
+	if maxAge > 0 && age > maxAge {
+		return false, fmt.Sprintf("last sync was %v ago, exceeds %v",
+			age.Round(time.Millisecond), maxAge)
+	}
+	if maxOffset > 0 && (offset > maxOffset || offset < -maxOffset) {
+		return false, fmt.Sprintf("offset %v exceeds %v", offset, maxOffset)
+	}
+	return true, fmt.Sprintf("synced %v ago with offset %v",
+		age.Round(time.Millisecond), offset)
+}
+
+// LastStatus returns the HTTP status code of the response of the last
+// successful Sync, such as 404 for Google. A status that is unexpected for
+// the server, such as 400, may indicate that the Date header came from a
+// proxy rather than the server. Returns zero if time has not been synced, or
+// when the time was not fetched over HTTP.
+func LastStatus() int {
+	return std.LastStatus()
+}
+
+// LastRemoteAddr returns the remote address, such as "142.250.72.14:80", of
+// the connection that was used by the last successful Sync. This shows which
+// server was reached when the host resolves to many addresses, such as with
+// anycast or a CDN. The address is of the proxy when a proxy is used.
+// Returns an empty string if time has not been synced, or when the time was
+// not fetched from a server, such as by SyncSource.
+func LastRemoteAddr() string {
+	return std.LastRemoteAddr()
+}
+
+// Uncertainty returns the estimated maximum error of the time measured by
+// the last successful Sync. This is derived from the round-trip time and the
+// precision of the time reported by the server, which is one second for
+// Sync and can be much less for SyncPrecise and SyncNTP. Returns zero if time
+// has not been synced, or when the source does not provide an estimate.
+func Uncertainty() time.Duration {
+	return std.Uncertainty()
+}
+
+// LastServerTime returns the time that was reported by the server during
+// the last successful Sync, prior to any adjustments. For HTTP servers this is
+// the value of the Date header. Returns the zero time if time has not been
+// synced.
+func LastServerTime() time.Time {
+	return std.LastServerTime()
+}
+
+// EstimateDrift returns the drift rate of the local clock in parts per
+// million, as measured between the last two successful syncs that are far
+// enough apart for the uncertainty of their times, see Uncertainty. The rate
+// is limited to 500 parts per million. A positive value means that the local
+// clock runs slower than Google time.
+// Returns ErrNoDrift if the time has not been synced at least twice, far
+// enough apart.
+func EstimateDrift() (float64, error) {
+	std.mu.RLock()
+	drifted, ppm := std.drifted, std.drift
+	std.mu.RUnlock()
+	if !drifted {
+		return 0, ErrNoDrift
+	}
+	return ppm, nil
+}
+
+// EnableDriftCorrection turns on or off drift correction. When on, the time
+// returned by Now is corrected, in proportion to the time elapsed since the
+// last sync, by the drift rate measured between the last two syncs. This
+// keeps the time accurate for longer on machines with a drifty clock.
+// Off by default.
+func EnableDriftCorrection(enabled bool) {
+	std.EnableDriftCorrection(enabled)
+}
+
+// maxDrift is the maximum drift rate in parts per million, which is far
+// beyond that of any working clock.
+const maxDrift = 500
+
+// drift returns the drift rate in parts per million between two syncs,
+// limited to the maximum drift rate.
+func drift(t1 time.Time, nano1 time.Duration, t2 time.Time,
+	nano2 time.Duration,
+) float64 {
+	elapsed := nano2 - nano1
+	ppm := float64(t2.Sub(t1)-elapsed) / float64(elapsed) * 1e6
+	return max(-maxDrift, min(ppm, maxDrift))
+}
+
+// SyncCount returns the number of successful and failed syncs since the
+// program started.
+func SyncCount() (success, failure uint64) {
+	stats := std.Stats()
+	return stats.Synced, stats.Failed
+}
+
+// SetLogger sets a function that logs what happens while syncing, such as
+// the host that was dialed, the date that was read, the resulting offset,
+// and any errors. This is useful for diagnosing sync failures. For example,
+// gtime.SetLogger(log.Printf). A nil function turns off logging, which is
+// the default.
+func SetLogger(logf func(format string, args ...any)) {
+	gmu.Lock()
+	glogf = logf
+	gmu.Unlock()
+}
+
+// logf logs using the function set by SetLogger.
+func logf(format string, args ...any) {
+	gmu.RLock()
+	fn := glogf
+	gmu.RUnlock()
+	if fn != nil {
+		fn(format, args...)
+	}
+}
+
+// SyncStats contains statistics about syncing.
+type SyncStats struct {
+	Synced  uint64        // number of successful syncs
+	Failed  uint64        // number of failed syncs
+	LastRTT time.Duration // round-trip time of the last successful sync
+	Offset  time.Duration // offset measured by the last successful sync
+}
+
+// Stats returns statistics about syncing since the program started. This is
+// useful for exposing metrics.
+func Stats() SyncStats {
+	return std.Stats()
+}
+
+// State returns a summary of the sync state for debugging, which includes
+// the offset, the local system time of the last successful sync, and the
+// round-trip time of its request.
+func State() string {
+	std.mu.RLock()
+	defer std.mu.RUnlock()
+	if !std.synced {
+		return "not synced"
+	}
+	return fmt.Sprintf("synced: offset %v, last sync %v, rtt %v", std.offset,
+		std.last.Round(0), std.rtt)
+}
+
+// hostPort returns the host with the port added when it's missing a port.
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// canceled returns an error that wraps ctx.Err() when the context is done,
+// otherwise err is returned. This gives preference to the context error over
+// whatever the network returned when the operation was interrupted.
+func canceled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("sync canceled: %w", ctx.Err())
+	}
+	return err
+}
+
+// watch applies the context deadline to the connection and interrupts any
+// pending read or write when the context is done. The returned function
+// stops watching the context.
+func watch(ctx context.Context, c net.Conn) (stop func() bool, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
 	}
-	return t.Local(), nano, nil
+	return context.AfterFunc(ctx, func() {
+		c.SetDeadline(time.Unix(1, 0))
+	}), nil
 }
@@ -1,15 +1,2046 @@
 package gtime
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/tidwall/gtime/gtimetest"
 )
 
 func TestNow(t *testing.T) {
-	Sync(time.Second)
+	defer Reset()
+	if err := SyncHost(testServer(t, time.Now), time.Second); err != nil {
+		t.Fatal(err)
+	}
 	t1 := Now()
 	t2 := Now()
 	if t1.After(t2) {
 		t.Fatalf("time out of order, %v > %v", t1, t2)
 	}
 }
+
+func TestSyncContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := SyncContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// testServer starts a local server that responds to every request with a
+// Date header using the time returned by now. Returns the "host:port" of the
+// server.
+func testServer(t *testing.T, now func() time.Time) string {
+	return testTimeServer(t, now).Addr
+}
+
+// testTimeServer is like testServer but returns the server, which allows for
+// inspecting the requests that it received.
+func testTimeServer(t *testing.T, now func() time.Time) *gtimetest.Server {
+	srv := gtimetest.NewServer(now)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// testRawServer starts a local server that responds to every request with
+// the response returned by resp. Returns the "host:port" of the server.
+func testRawServer(t *testing.T, resp func() string) string {
+	srv := gtimetest.NewRawServer(resp)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr
+}
+
+// testConnServer starts a local server that calls handle for every
+// connection that it accepts, and closes the connection when handle returns.
+// A nil handle holds the connection open without responding until the test
+// ends. Returns the "host:port" of the server.
+func testConnServer(t *testing.T, handle func(c net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		ln.Close()
+	})
+	if handle == nil {
+		handle = func(net.Conn) { <-done }
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSyncHost(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	host := testServer(t, func() time.Time { return date })
+	if err := SyncHost(host, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	now := Now()
+	if now.Before(date) || now.After(date.Add(time.Second)) {
+		t.Fatalf("expected %v, got %v", date, now)
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for _, tc := range []struct{ host, expect string }{
+		{"example.com", "example.com:80"},
+		{"example.com:8080", "example.com:8080"},
+		{"::1", "[::1]:80"},
+		{"[::1]:8080", "[::1]:8080"},
+	} {
+		if got := hostPort(tc.host, "80"); got != tc.expect {
+			t.Fatalf("expected %q, got %q", tc.expect, got)
+		}
+	}
+}
+
+func TestGetPrecise(t *testing.T) {
+	offset := time.Hour + time.Millisecond*300
+	host := testServer(t, func() time.Time { return time.Now().Add(offset) })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	s, err := getPrecise(ctx, &Config{Host: host}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.t.Sub(s.local) - offset
+	if d < -time.Millisecond*100 || d > time.Millisecond*100 {
+		t.Fatalf("offset is off by %v", d)
+	}
+}
+
+type testSource time.Time
+
+func (src testSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return time.Time(src), nil
+}
+
+func TestSyncSource(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	now := Now()
+	if now.Before(date) || now.After(date.Add(time.Second)) {
+		t.Fatalf("expected %v, got %v", date, now)
+	}
+}
+
+func TestSyncSourceSample(t *testing.T) {
+	defer Reset()
+	host := testServer(t, time.Now)
+	if err := SyncSource(HTTPSource{Config{Host: host}},
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the measurements of the request are kept, not just the time.
+	if u := Uncertainty(); u < time.Second || u != time.Second+LastRTT()/2 {
+		t.Fatalf("unexpected uncertainty %v for rtt %v", u, LastRTT())
+	}
+	if LastStatus() != 404 || LastRemoteAddr() != host {
+		t.Fatalf("unexpected status %d from %s", LastStatus(),
+			LastRemoteAddr())
+	}
+}
+
+func TestNowMono(t *testing.T) {
+	if err := SyncSource(testSource(time.Now().Add(time.Hour)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	t1 := NowMono()
+	time.Sleep(time.Millisecond * 10)
+	t2 := NowMono()
+	if d := t2.Sub(t1); d < time.Millisecond*10 || d > time.Second {
+		t.Fatalf("unexpected elapsed time %v", d)
+	}
+	if d := t1.Sub(time.Now()); d < time.Minute*59 {
+		t.Fatalf("expected an hour offset, got %v", d)
+	}
+}
+
+func TestSyncConfigDialContext(t *testing.T) {
+	host := testServer(t, time.Now)
+	var dialed string
+	err := SyncConfig(Config{
+		Host: "example.com",
+		DialContext: func(ctx context.Context, network, addr string,
+		) (net.Conn, error) {
+			dialed = addr
+			var d net.Dialer
+			return d.DialContext(ctx, network, host)
+		},
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialed != "example.com:80" {
+		t.Fatalf("expected %q, got %q", "example.com:80", dialed)
+	}
+}
+
+func TestSyncTLS(t *testing.T) {
+	defer Reset()
+	Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+		}))
+	// the rejected handshake is expected.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	defer func(host string) { tlsHost = host }(tlsHost)
+	tlsHost = srv.Listener.Addr().String()
+	// the certificate of the server is not trusted by default.
+	var serr *SyncError
+	if err := SyncTLS(time.Second); !errors.As(err, &serr) ||
+		serr.Op != "handshake" {
+		t.Fatalf("expected a handshake error, got %v", err)
+	}
+	if IsSynced() {
+		t.Fatal("expected to not be synced")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	if err := SyncTLSConfig(&tls.Config{RootCAs: roots},
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !LastServerTime().Equal(date) {
+		t.Fatalf("expected %v, got %v", date, LastServerTime())
+	}
+	if d := Offset() - time.Hour; d < -time.Second*2 || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+}
+
+func TestSyncConfigNetwork(t *testing.T) {
+	host := testServer(t, time.Now)
+	err := SyncConfig(Config{Host: host, Network: "tcp6"}, time.Second)
+	if err == nil {
+		t.Fatal("expected an error dialing an IPv4 address over tcp6")
+	}
+	if err := SyncConfig(Config{Host: host, Network: "tcp4"},
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMulti(t *testing.T) {
+	offsets := []time.Duration{time.Hour, time.Hour * 2, time.Hour * 100}
+	var hosts []string
+	for _, offset := range offsets {
+		offset := offset
+		hosts = append(hosts, testServer(t, func() time.Time {
+			return time.Now().Add(offset)
+		}))
+	}
+	hosts = append(hosts, "127.0.0.1:1")
+	if err := SyncMulti(hosts, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := Offset() - time.Hour*2; d < -time.Second || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+	results := LastMultiResults()
+	if len(results) != len(hosts) {
+		t.Fatalf("expected %d results, got %d", len(hosts), len(results))
+	}
+	for i, r := range results {
+		if (i == 1) != (r.Weight == 1) || (i == 3) != (r.Err != nil) {
+			t.Fatalf("unexpected result %d: %+v", i, r)
+		}
+	}
+	if err := SyncQuorum(hosts, 4, time.Second); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestEstimateDrift(t *testing.T) {
+	base := time.Now().Add(time.Hour).Truncate(time.Second)
+	if d := drift(base, 0, base.Add(time.Second+time.Microsecond*50),
+		time.Second); d != 50 {
+		t.Fatalf("expected %v, got %v", 50, d)
+	}
+	defer Reset()
+	Reset()
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	SyncSource(testSource(base), time.Second)
+	nano += time.Second
+	SyncSource(testSource(base.Add(time.Second+time.Microsecond*50)),
+		time.Second)
+	if d, err := EstimateDrift(); err != nil || d != 50 {
+		t.Fatalf("expected %v, got %v, %v", 50, d, err)
+	}
+}
+
+func TestEstimateDriftCoarse(t *testing.T) {
+	defer Reset()
+	defer EnableDriftCorrection(false)
+	Reset()
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncHost(testServer(t, func() time.Time { return date }),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// 1.5 seconds later the Date header reads one second later, which is
+	// within the uncertainty of a second of each time.
+	nano += time.Millisecond * 1500
+	later := date.Add(time.Second)
+	if err := SyncHost(testServer(t, func() time.Time { return later }),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ppm, err := EstimateDrift(); err != ErrNoDrift {
+		t.Fatalf("expected ErrNoDrift, got %v, %v", ppm, err)
+	}
+	EnableDriftCorrection(true)
+	nano += time.Hour
+	if now, exp := Now(), later.Add(time.Hour); !now.Equal(exp) {
+		t.Fatalf("expected %v, got %v", exp, now)
+	}
+	// an implausible drift is limited.
+	if err := SyncSource(testSource(later), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	nano += time.Second
+	if err := SyncSource(testSource(later.Add(time.Second*2)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ppm, err := EstimateDrift(); err != nil || ppm != maxDrift {
+		t.Fatalf("expected %v, got %v, %v", maxDrift, ppm, err)
+	}
+}
+
+func TestLargeHeader(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	host := testRawServer(t, func() string {
+		return "HTTP/1.0 404 Not Found\r\n" +
+			strings.Repeat("X-Padding: "+strings.Repeat("x", 100)+"\r\n", 20) +
+			"Date: " + date.UTC().Format(http.TimeFormat) + "\r\n\r\n"
+	})
+	if err := SyncHost(host, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !LastServerTime().Equal(date) {
+		t.Fatalf("expected %v, got %v", date, LastServerTime())
+	}
+}
+
+func TestLowercaseHeader(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	host := testRawServer(t, func() string {
+		return "HTTP/1.0 404 Not Found\r\n" +
+			"date: " + date.UTC().Format(http.TimeFormat) + "\r\n\r\n"
+	})
+	if err := SyncHost(host, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !LastServerTime().Equal(date) {
+		t.Fatalf("expected %v, got %v", date, LastServerTime())
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	expect := time.Date(1994, 11, 6, 8, 49, 37, 0, time.UTC)
+	for _, dts := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sun, 06 Nov 1994 08:49:37 +0000",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+	} {
+		date, err := parseDate(dts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !date.Equal(expect) {
+			t.Fatalf("expected %v, got %v", expect, date)
+		}
+	}
+	if _, err := parseDate("invalid"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSyncError(t *testing.T) {
+	host := testRawServer(t, func() string {
+		return "HTTP/1.0 404 Not Found\r\n\r\n"
+	})
+	err := SyncHost(host, time.Second)
+	var serr *SyncError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a SyncError, got %v", err)
+	}
+	if serr.Op != "parse" || serr.Host != host {
+		t.Fatalf("unexpected error %v", serr)
+	}
+	if !errors.Is(err, ErrNoDateHeader) {
+		t.Fatalf("expected %v, got %v", ErrNoDateHeader, err)
+	}
+}
+
+func TestOnSync(t *testing.T) {
+	var called bool
+	var offset time.Duration
+	OnSync(func(o time.Duration, _ time.Time) {
+		called, offset = true, o
+	})
+	if err := SyncSource(testSource(time.Now().Add(time.Hour)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !called || offset != Offset() {
+		t.Fatalf("expected %v, got %v", Offset(), offset)
+	}
+}
+
+func TestFakeSource(t *testing.T) {
+	date := time.Now().Truncate(time.Second)
+	clock := NewFakeClock(date)
+	clock.Advance(time.Hour)
+	if err := SyncSource(FakeSource{clock}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expect := date.Add(time.Hour)
+	if !LastServerTime().Equal(expect) {
+		t.Fatalf("expected %v, got %v", expect, LastServerTime())
+	}
+}
+
+func TestMaxSkew(t *testing.T) {
+	err := SyncSource(testSource(time.Now().Add(time.Hour*25)), time.Second)
+	if !errors.Is(err, ErrMaxSkew) {
+		t.Fatalf("expected %v, got %v", ErrMaxSkew, err)
+	}
+}
+
+func TestSetHost(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	SetHost(testServer(t, func() time.Time { return date }))
+	defer SetHost("")
+	if err := Sync(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !LastServerTime().Equal(date) {
+		t.Fatalf("expected %v, got %v", date, LastServerTime())
+	}
+}
+
+func TestConfigRequest(t *testing.T) {
+	cfg := Config{
+		Method: "GET",
+		Path:   "/",
+		Header: http.Header{"Host": {"example.com"}, "Connection": {"close"}},
+	}
+	expect := "GET / HTTP/1.1\r\nConnection: close\r\nHost: example.com\r\n\r\n"
+	if got := cfg.request(false); got != expect {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+	cfg = Config{}
+	expect = "HEAD / HTTP/1.1\r\nHost: google.com\r\nConnection: close\r\n\r\n"
+	if got := cfg.request(false); got != expect {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+	if got := cfg.legacyRequest(); got != "HEAD / HTTP/1.0\r\n\r\n" {
+		t.Fatalf("unexpected request %q", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	stats := Stats()
+	SyncSource(testSource(time.Now()), time.Second)
+	SyncHost("127.0.0.1:1", time.Second)
+	after := Stats()
+	if after.Synced != stats.Synced+1 || after.Failed != stats.Failed+1 {
+		t.Fatalf("unexpected stats %+v, previously %+v", after, stats)
+	}
+}
+
+func TestReset(t *testing.T) {
+	SyncSource(testSource(time.Now()), time.Second)
+	Reset()
+	if IsSynced() {
+		t.Fatal("expected unsynced")
+	}
+	if _, err := NowErr(); !errors.Is(err, ErrNotSynced) {
+		t.Fatalf("expected %v, got %v", ErrNotSynced, err)
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	SetHost(testServer(t, func() time.Time {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		return time.Now()
+	}))
+	defer SetHost("")
+	for i := 0; i < 3; i++ {
+		if err := Sync(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetMinInterval(0)
+	defer SetMinInterval(time.Second)
+	if err := Sync(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Fatalf("expected %d requests, got %d", 2, requests)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	host := testServer(t, time.Now)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	targets := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		targets <- req.Host
+		tc, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer tc.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(tc, c)
+		io.Copy(c, tc)
+	}()
+	proxy := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	err = SyncConfig(Config{Host: host, Proxy: ProxyURL(proxy)}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := <-targets; target != host {
+		t.Fatalf("expected %q, got %q", host, target)
+	}
+}
+
+func TestSyncChain(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	err := SyncChain(time.Second,
+		HTTPSource{Config{Host: "127.0.0.1:1"}},
+		HTTPSource{Config{Host: testServer(t, func() time.Time {
+			return date
+		})}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := LastServerTime().Sub(date); d < 0 || d > time.Second {
+		t.Fatalf("expected %v, got %v", date, LastServerTime())
+	}
+	err = SyncChain(time.Second, HTTPSource{Config{Host: "127.0.0.1:1"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestNowElapsed(t *testing.T) {
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	nano += time.Minute + time.Nanosecond
+	if now := Now(); !now.Equal(date.Add(time.Minute + time.Nanosecond)) {
+		t.Fatalf("expected %v, got %v", date.Add(time.Minute), now)
+	}
+}
+
+func TestSyncAtZeroNano(t *testing.T) {
+	defer Reset()
+	nano := time.Duration(0)
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSynced() {
+		t.Fatal("expected synced")
+	}
+	nano += time.Second
+	if now := Now(); !now.Equal(date.Add(time.Second)) {
+		t.Fatalf("expected %v, got %v", date.Add(time.Second), now)
+	}
+}
+
+func TestPreciseKeepAlive(t *testing.T) {
+	var conns atomic.Int32
+	host := testConnServer(t, func(c net.Conn) {
+		conns.Add(1)
+		b := make([]byte, 4096)
+		for {
+			if _, err := c.Read(b); err != nil {
+				return
+			}
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nDate: "+
+				time.Now().UTC().Format(http.TimeFormat)+"\r\n\r\n")
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := getPrecise(ctx, &Config{Host: host}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected %d connection, got %d", 1, n)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	host := testConnServer(t, nil)
+	start := time.Now()
+	err := SyncConfig(Config{
+		Host:        host,
+		ReadTimeout: time.Millisecond * 50,
+	}, time.Second*5)
+	var serr *SyncError
+	if !errors.As(err, &serr) || serr.Op != "read" {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("read timeout not honored")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	defer Reset()
+	addr := testServer(t, time.Now)
+	_, port, _ := net.SplitHostPort(addr)
+	var dialed []string
+	var fail bool
+	var d net.Dialer
+	cfg := Config{
+		Host:        "localhost:" + port,
+		Network:     "tcp4",
+		DNSCacheTTL: time.Minute,
+		DialContext: func(ctx context.Context, network, addr string,
+		) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			if fail && addr != "localhost:"+port {
+				return nil, errors.New("unreachable")
+			}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := SyncConfig(cfg, time.Second*5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fail = true
+	if err := SyncConfig(cfg, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{cfg.Host, addr, addr, cfg.Host}
+	if strings.Join(dialed, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %v, got %v", exp, dialed)
+	}
+}
+
+func TestSyncIPs(t *testing.T) {
+	defer Reset()
+	srv := testTimeServer(t, time.Now)
+	// a port that refuses connections.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	ips := []string{dead.Addr().String(), srv.Addr}
+	if err := SyncIPs(ips, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if host := srv.Requests()[0].Header.Get("Host"); host != "google.com" {
+		t.Fatalf("expected google.com host, got %q", host)
+	}
+	if ip := LastIP(); ip != ips[1] {
+		t.Fatalf("expected %s, got %s", ips[1], ip)
+	}
+	if err := SyncIPs(ips[:1], time.Second*5); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSyncNotify(t *testing.T) {
+	defer Reset()
+	ch1, cancel1 := SyncNotify()
+	ch2, cancel2 := SyncNotify()
+	defer cancel2()
+	now := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(now), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []<-chan time.Time{ch1, ch2} {
+		select {
+		case st := <-ch:
+			if d := st.Sub(now); d < 0 || d > time.Second {
+				t.Fatalf("expected %v, got %v", now, st)
+			}
+		default:
+			t.Fatal("expected a notification")
+		}
+	}
+	cancel1()
+	if err := SyncSource(testSource(now), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch1:
+		t.Fatal("expected no notification after cancel")
+	default:
+	}
+	select {
+	case <-ch2:
+	default:
+		t.Fatal("expected a notification")
+	}
+}
+
+func TestSmoothOffset(t *testing.T) {
+	defer Reset()
+	defer SmoothOffset(false)
+	SmoothOffset(true)
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the server is now one second behind.
+	nano += time.Minute
+	if err := SyncSource(testSource(date.Add(time.Minute-time.Second)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if now := Now(); !now.Equal(date.Add(time.Minute)) {
+		t.Fatalf("expected %v, got %v", date.Add(time.Minute), now)
+	}
+	nano += time.Second * 1000
+	exp := date.Add(time.Minute + time.Second*1000 - time.Second/2)
+	if now := Now(); !now.Equal(exp) {
+		t.Fatalf("expected %v, got %v", exp, now)
+	}
+	nano += time.Second * 2000
+	exp = date.Add(time.Minute + time.Second*2999)
+	if now := Now(); !now.Equal(exp) {
+		t.Fatalf("expected %v, got %v", exp, now)
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	defer Reset()
+	defer Monotonic(false)
+	Monotonic(true)
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// going backwards slews.
+	nano += time.Minute
+	if err := SyncSource(testSource(date.Add(time.Minute-time.Second)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if now := Now(); !now.Equal(date.Add(time.Minute)) {
+		t.Fatalf("expected %v, got %v", date.Add(time.Minute), now)
+	}
+	// going forward steps.
+	if err := SyncSource(testSource(date.Add(time.Minute+time.Second)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	exp := date.Add(time.Minute + time.Second)
+	if now := Now(); !now.Equal(exp) {
+		t.Fatalf("expected %v, got %v", exp, now)
+	}
+	// the first sync after a reset steps, but never before a returned time.
+	Reset()
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if now := Now(); !now.Equal(exp) {
+		t.Fatalf("expected %v, got %v", exp, now)
+	}
+}
+
+func TestSyncMultiStraggler(t *testing.T) {
+	defer Reset()
+	now := func() time.Time { return time.Now().Add(time.Hour) }
+	hosts := []string{testServer(t, now), testConnServer(t, nil),
+		testServer(t, now)}
+	start := time.Now()
+	if err := SyncMulti(hosts, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("straggler was not canceled")
+	}
+	if r := LastMultiResults(); r[1].Err == nil {
+		t.Fatalf("unexpected result: %+v", r[1])
+	}
+	start = time.Now()
+	err := SyncQuorumTimeout(hosts, 3, time.Second*5, time.Millisecond*100)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("host timeout not honored")
+	}
+}
+
+func TestSyncMultiDisagree(t *testing.T) {
+	defer Reset()
+	good := testServer(t, gtimetest.Offset(time.Hour))
+	bad := testServer(t, gtimetest.Offset(time.Hour*21))
+	slow := testRawServer(t, func() string {
+		time.Sleep(time.Millisecond * 300)
+		return gtimetest.Response(time.Now().Add(time.Hour))
+	})
+	// the quorum is reached by the good and bad hosts, which disagree, so
+	// the slow host decides.
+	hosts := []string{good, bad, slow}
+	if err := SyncMulti(hosts, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if d := Offset() - time.Hour; d < -time.Second || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+	if r := LastMultiResults(); r[2].Err != nil || r[1].Weight != 0 {
+		t.Fatalf("unexpected results: %+v", r)
+	}
+	// two hosts that disagree have no median to trust.
+	offset := Offset()
+	if err := SyncMulti([]string{good, bad}, time.Second*5); err == nil {
+		t.Fatal("expected an error")
+	}
+	if Offset() != offset {
+		t.Fatalf("expected %v, got %v", offset, Offset())
+	}
+}
+
+func TestLocalAheadBy(t *testing.T) {
+	defer Reset()
+	Reset()
+	if ahead := LocalAheadBy(); ahead != 0 {
+		t.Fatalf("expected zero, got %v", ahead)
+	}
+	now := func() time.Time { return time.Now().Add(-time.Hour) }
+	if err := SyncHost(testServer(t, now), time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if ahead := LocalAheadBy(); ahead < time.Hour-time.Second*3 ||
+		ahead > time.Hour {
+		t.Fatalf("expected about an hour, got %v", ahead)
+	}
+	now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := SyncHost(testServer(t, now), time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if ahead := LocalAheadBy(); ahead != 0 {
+		t.Fatalf("expected zero, got %v", ahead)
+	}
+}
+
+func TestLegacyFallback(t *testing.T) {
+	defer Reset()
+	host := testConnServer(t, func(c net.Conn) {
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		// only responds to HTTP/1.0 requests.
+		if strings.HasSuffix(line, "HTTP/1.0\r\n") {
+			io.WriteString(c, gtimetest.Response(time.Now()))
+		}
+	})
+	if err := SyncHost(host, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncAvg(t *testing.T) {
+	defer Reset()
+	defer SetHost("")
+	var mu sync.Mutex
+	offsets := []time.Duration{time.Hour, time.Hour, time.Hour * 5,
+		time.Hour + time.Second}
+	SetHost(testServer(t, func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		offset := offsets[0]
+		offsets = offsets[1:]
+		return time.Now().Add(offset)
+	}))
+	if err := SyncAvg(4, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	// the five hour offset is discarded.
+	exp := time.Hour + time.Second/3
+	if d := Offset() - exp; d < -time.Second || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+	if sd := LastStdDev(); sd < time.Millisecond*100 || sd > time.Second {
+		t.Fatalf("unexpected standard deviation %v", sd)
+	}
+	// two samples that disagree have no median to trust, which must not be
+	// mistaken for a skewed offset.
+	SetMaxSkew(0)
+	defer SetMaxSkew(time.Hour * 24)
+	offset := Offset()
+	mu.Lock()
+	offsets = []time.Duration{time.Hour * 2, time.Hour*2 + time.Second*3}
+	mu.Unlock()
+	if err := SyncAvg(2, time.Second*5); err == nil {
+		t.Fatal("expected an error")
+	}
+	if Offset() != offset {
+		t.Fatalf("expected %v, got %v", offset, Offset())
+	}
+	Reset()
+	if sd := LastStdDev(); sd != 0 {
+		t.Fatalf("expected zero, got %v", sd)
+	}
+}
+
+func TestNanotime(t *testing.T) {
+	// the monotonic clock must advance along with the time package.
+	start, nano := time.Now(), runtimeNano()
+	time.Sleep(time.Millisecond * 10)
+	elapsed, nelapsed := time.Since(start), runtimeNano()-nano
+	if d := elapsed - nelapsed; d < -time.Millisecond || d > time.Millisecond {
+		t.Fatalf("expected %v, got %v", elapsed, nelapsed)
+	}
+}
+
+func BenchmarkNanotime(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		runtimeNano()
+	}
+}
+
+func BenchmarkNow(b *testing.B) {
+	SyncSource(testSource(time.Now()), time.Second)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Now()
+	}
+}
+
+func TestForceLocal(t *testing.T) {
+	defer Reset()
+	defer ForceLocal(false)
+	defer Monotonic(false)
+	Monotonic(true)
+	if err := SyncSource(testSource(time.Now().Add(time.Hour)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	Now()
+	ForceLocal(true)
+	// the synced time that was returned in monotonic mode does not hold
+	// back the local time.
+	for i, now := range []func() time.Time{Now, NowMono} {
+		if d := time.Until(now()); d < -time.Second || d > time.Second {
+			t.Fatalf("now %d: expected the local time, off by %v", i, d)
+		}
+	}
+	if _, ok := NowSource(); ok {
+		t.Fatal("expected the local time to not be synced")
+	}
+	stats, ip := Stats(), LastIP()
+	srv := testTimeServer(t, time.Now)
+	SetHost(srv.Addr)
+	defer SetHost("")
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	syncs := []func() error{
+		func() error { return Sync(time.Second) },
+		func() error { return SyncHost(srv.Addr, time.Second) },
+		func() error { return SyncVia(srv.Addr, "example.com", time.Second) },
+		func() error { return SyncWithFloor(time.Time{}, time.Second) },
+		func() error { return SyncIPs([]string{srv.Addr}, time.Second) },
+		func() error { return SyncPrecise(2, time.Second) },
+		func() error { return SyncAvg(2, time.Second) },
+		func() error { return SyncMulti([]string{srv.Addr}, time.Second) },
+		func() error {
+			return SyncSource(HTTPSource{Config{Host: srv.Addr}}, time.Second)
+		},
+		func() error { return SyncNTP(udp.LocalAddr().String(), time.Second) },
+	}
+	for i, sync := range syncs {
+		if err := sync(); err != nil {
+			t.Fatalf("sync %d: %v", i, err)
+		}
+	}
+	if n := srv.Conns(); n != 0 {
+		t.Fatalf("expected no connections, got %d", n)
+	}
+	udp.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, _, err := udp.ReadFrom(make([]byte, 48)); err == nil {
+		t.Fatal("expected no ntp request")
+	}
+	if Stats() != stats || LastIP() != ip {
+		t.Fatal("expected no sync")
+	}
+	ForceLocal(false)
+	if d := time.Until(Now()); d < time.Hour-time.Second {
+		t.Fatalf("expected the synced time, off by %v", d)
+	}
+	Reset()
+	ForceLocal(true)
+	if _, ok := NowSource(); ok {
+		t.Fatal("expected the local time to not be synced")
+	}
+}
+
+func TestNowIn(t *testing.T) {
+	defer Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	loc := time.FixedZone("test", 3600*5)
+	now := NowIn(loc)
+	if now.Location() != loc {
+		t.Fatalf("expected %v, got %v", loc, now.Location())
+	}
+	if d := now.Sub(date); d < 0 || d > time.Second {
+		t.Fatalf("expected %v, got %v", date, now)
+	}
+}
+
+func BenchmarkNowParallel(b *testing.B) {
+	SyncSource(testSource(time.Now()), time.Second)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Now()
+		}
+	})
+}
+
+func TestNeedsSync(t *testing.T) {
+	defer Reset()
+	Reset()
+	if !NeedsSync(time.Hour) {
+		t.Fatal("expected true")
+	}
+	SyncSource(testSource(time.Now()), time.Second)
+	if NeedsSync(time.Hour) {
+		t.Fatal("expected false")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if !NeedsSync(time.Millisecond) {
+		t.Fatal("expected true")
+	}
+}
+
+func TestAutoSyncWait(t *testing.T) {
+	defer Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Hour).Add(time.Minute * 45)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	wait := AutoSyncOptions{Align: true}.wait(time.Hour)
+	if d := wait - time.Minute*15; d < -time.Second || d > 0 {
+		t.Fatalf("expected %v, got %v", time.Minute*15, wait)
+	}
+	for i := 0; i < 100; i++ {
+		wait := AutoSyncOptions{Jitter: time.Second}.wait(time.Minute)
+		if wait < time.Minute || wait >= time.Minute+time.Second {
+			t.Fatalf("unexpected wait %v", wait)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	defer Reset()
+	Reset()
+	if state := State(); state != "not synced" {
+		t.Fatalf("unexpected state %q", state)
+	}
+	SyncSource(testSource(time.Now().Add(time.Hour)), time.Second)
+	if state := State(); !strings.HasPrefix(state, "synced: offset 59m59.") {
+		t.Fatalf("unexpected state %q", state)
+	}
+}
+
+func TestFoldedHeader(t *testing.T) {
+	defer Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	host := testRawServer(t, func() string {
+		return "HTTP/1.1 404 Not Found\r\n" +
+			"X-Folded: first\r\n second\r\n" +
+			"Date:\r\n " + date.UTC().Format(http.TimeFormat) + "\r\n\r\n"
+	})
+	if err := SyncHost(host, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !LastServerTime().Equal(date) {
+		t.Fatalf("expected %v, got %v", date, LastServerTime())
+	}
+	host = testRawServer(t, func() string {
+		return "HTTP/1.1 404 Not Found\r\n" +
+			strings.Repeat("X-Padding: "+strings.Repeat("x", 100)+"\r\n", 100) +
+			"\r\n"
+	})
+	if err := SyncHost(host, time.Second); err == nil ||
+		!strings.Contains(err.Error(), "too large") {
+		t.Fatalf("expected a too large error, got %v", err)
+	}
+}
+
+func TestSyncInspect(t *testing.T) {
+	defer SetHost("")
+	Reset()
+	SetHost(testServer(t, func() time.Time {
+		return time.Now().Add(time.Hour)
+	}))
+	m, err := SyncInspect(time.Second * 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := m.Offset - time.Hour; d < -time.Second*2 || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+	if m.Uncertainty < time.Second ||
+		!m.ServerTime.Equal(m.LocalTime.Add(m.Offset)) {
+		t.Fatalf("unexpected measurement %+v", m)
+	}
+	if IsSynced() {
+		t.Fatal("expected unsynced")
+	}
+}
+
+func TestSyncer(t *testing.T) {
+	defer Reset()
+	Reset()
+	c1 := New(Config{Host: testServer(t, func() time.Time {
+		return time.Now().Add(time.Hour)
+	})})
+	c2 := New(Config{Host: testServer(t, func() time.Time {
+		return time.Now().Add(-time.Hour)
+	})})
+	if err := c1.Sync(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Sync(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	if d := c1.Offset() - time.Hour; d < -time.Second*2 || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+	if d := c2.Offset() + time.Hour; d < -time.Second*2 || d > time.Second {
+		t.Fatalf("offset is off by %v", d)
+	}
+	if d := c1.Now().Sub(c2.Now()); d < time.Hour || d > time.Hour*3 {
+		t.Fatalf("unexpected difference %v", d)
+	}
+	if IsSynced() {
+		t.Fatal("expected the package to be unsynced")
+	}
+	c1.Reset()
+	if _, err := c1.NowErr(); !errors.Is(err, ErrNotSynced) {
+		t.Fatalf("expected %v, got %v", ErrNotSynced, err)
+	}
+}
+
+func TestOnStep(t *testing.T) {
+	c := New(Config{})
+	var deltas []time.Duration
+	c.OnStep(func(delta time.Duration) {
+		deltas = append(deltas, delta)
+	})
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	now := time.Now()
+	for _, offset := range []time.Duration{0, time.Second, time.Minute} {
+		nano += time.Second
+		now = now.Add(time.Second)
+		c.commit(sample{t: now.Add(offset), local: now, nano: nano}, nil)
+	}
+	if len(deltas) != 1 || deltas[0] != time.Minute-time.Second {
+		t.Fatalf("unexpected deltas %v", deltas)
+	}
+}
+
+func TestStartAutoSyncContext(t *testing.T) {
+	defer Reset()
+	defer SetHost("")
+	defer SetMinInterval(time.Second)
+	Reset()
+	SetMinInterval(0)
+	SetHost(testServer(t, func() time.Time {
+		return time.Now().Add(time.Hour)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	synced, unsubscribe := SyncNotify()
+	defer unsubscribe()
+	StartAutoSyncContext(ctx, time.Millisecond*10)
+	select {
+	case <-synced:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected a sync")
+	}
+	cancel()
+}
+
+func TestUnixNano(t *testing.T) {
+	defer Reset()
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	nano += time.Minute + time.Nanosecond
+	exp := date.Add(time.Minute + time.Nanosecond)
+	if n := UnixNano(); n != exp.UnixNano() {
+		t.Fatalf("expected %v, got %v", exp.UnixNano(), n)
+	}
+	if n := Unix(); n != exp.Unix() {
+		t.Fatalf("expected %v, got %v", exp.Unix(), n)
+	}
+}
+
+func BenchmarkUnixNano(b *testing.B) {
+	SyncSource(testSource(time.Now()), time.Second)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		UnixNano()
+	}
+}
+
+func TestPanicOnUnsynced(t *testing.T) {
+	defer PanicOnUnsynced(true)
+	Reset()
+	func() {
+		defer func() {
+			if err, ok := recover().(error); !ok ||
+				!errors.Is(err, ErrNotSynced) {
+				t.Fatalf("expected %v, got %v", ErrNotSynced, err)
+			}
+		}()
+		Now()
+	}()
+	PanicOnUnsynced(false)
+	if d := time.Since(Now()); d < -time.Second || d > time.Second {
+		t.Fatalf("expected the local time, off by %v", d)
+	}
+}
+
+func TestPTPSource(t *testing.T) {
+	_, err := PTPSource{Device: t.TempDir() + "/ptp"}.Fetch(time.Second)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	defer Reset()
+	Reset()
+	if ok, reason := Healthy(time.Second, time.Minute); ok ||
+		reason != "not synced" {
+		t.Fatalf("unexpected result %v %q", ok, reason)
+	}
+	SyncSource(testSource(time.Now().Add(time.Hour)), time.Second)
+	if ok, reason := Healthy(time.Second, time.Minute); ok ||
+		!strings.HasPrefix(reason, "offset") {
+		t.Fatalf("unexpected result %v %q", ok, reason)
+	}
+	if ok, reason := Healthy(time.Hour*2, time.Nanosecond); ok ||
+		!strings.HasPrefix(reason, "last sync") {
+		t.Fatalf("unexpected result %v %q", ok, reason)
+	}
+	if ok, reason := Healthy(time.Hour*2, time.Minute); !ok {
+		t.Fatalf("unexpected result %v %q", ok, reason)
+	}
+}
+
+func TestRequestPath(t *testing.T) {
+	defer Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	paths := make(chan string, 1)
+	host := testRawServer(t, func() string {
+		return "HTTP/1.1 404 Not Found\r\n" +
+			"Date: " + date.UTC().Format(http.TimeFormat) + "\r\n\r\n"
+	})
+	var d net.Dialer
+	for _, path := range []string{"", "/", "-"} {
+		cfg := Config{Host: host, Path: path,
+			DialContext: func(ctx context.Context, network, addr string,
+			) (net.Conn, error) {
+				c, err := d.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &pathConn{Conn: c, paths: paths}, nil
+			},
+		}
+		if err := SyncConfig(cfg, time.Second*5); err != nil {
+			t.Fatal(err)
+		}
+		if !LastServerTime().Equal(date) {
+			t.Fatalf("expected %v, got %v", date, LastServerTime())
+		}
+		exp := path
+		if exp == "" {
+			exp = "/"
+		}
+		if got := <-paths; got != exp {
+			t.Fatalf("expected %q, got %q", exp, got)
+		}
+	}
+}
+
+// pathConn sends the path of the first request that is written to paths.
+type pathConn struct {
+	net.Conn
+	paths chan string
+	sent  bool
+}
+
+func (c *pathConn) Write(b []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		c.paths <- strings.Fields(string(b))[1]
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSyncWithFloor(t *testing.T) {
+	defer Reset()
+	defer SetHost("")
+	Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	SetHost(testServer(t, func() time.Time { return date }))
+	err := SyncWithFloor(date.Add(time.Minute), time.Second*5)
+	if !errors.Is(err, ErrBeforeFloor) {
+		t.Fatalf("expected %v, got %v", ErrBeforeFloor, err)
+	}
+	if IsSynced() {
+		t.Fatal("expected unsynced")
+	}
+	if err := SyncWithFloor(date.Add(-time.Minute), time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNowBoth(t *testing.T) {
+	defer Reset()
+	if err := SyncSource(testSource(time.Now().Add(time.Hour)),
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	google, local := NowBoth()
+	if d := google.Sub(local) - Offset(); d < -time.Millisecond ||
+		d > time.Millisecond {
+		t.Fatalf("expected the offset, off by %v", d)
+	}
+}
+
+func TestSetSmoothing(t *testing.T) {
+	c := New(Config{})
+	c.SetSmoothing(0.25)
+	now := time.Now()
+	c.commit(sample{t: now.Add(time.Hour), local: now, nano: 1}, nil)
+	c.commit(sample{t: now.Add(time.Hour + time.Second*4), local: now,
+		nano: 2}, nil)
+	if offset := c.Offset(); offset != time.Hour+time.Second {
+		t.Fatalf("expected %v, got %v", time.Hour+time.Second, offset)
+	}
+}
+
+func TestLastStatus(t *testing.T) {
+	defer Reset()
+	if err := SyncHost(testServer(t, time.Now), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if status := LastStatus(); status != 404 {
+		t.Fatalf("expected 404, got %d", status)
+	}
+	Reset()
+	if status := LastStatus(); status != 0 {
+		t.Fatalf("expected 0, got %d", status)
+	}
+}
+
+func TestJSONParser(t *testing.T) {
+	date := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+	tests := []struct {
+		p    JSONParser
+		body string
+	}{
+		{JSONParser{}, `{"utc_datetime":"2024-05-06T07:08:09.123456+00:00"}`},
+		{JSONParser{Field: "unixtime"}, `{"unixtime":1714979289.123456}`},
+		{JSONParser{Field: "t", Layout: "2006-01-02 15:04:05.000000"},
+			`{"t":"2024-05-06 07:08:09.123456"}`},
+	}
+	for _, test := range tests {
+		got, err := test.p.Parse([]byte(test.body))
+		if err != nil {
+			t.Fatalf("%s: %v", test.body, err)
+		}
+		if !got.Equal(date) {
+			t.Fatalf("%s: expected %v, got %v", test.body, date, got)
+		}
+	}
+	if _, err := (JSONParser{}).Parse([]byte(`{"unixtime":1}`)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestConfigParser(t *testing.T) {
+	defer Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	for _, chunked := range []bool{false, true} {
+		host := testRawServer(t, func() string {
+			body := `{"utc_datetime":"` + date.Format(time.RFC3339Nano) + `"}`
+			if chunked {
+				return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+					strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body +
+					"\r\n0\r\n\r\n"
+			}
+			return "HTTP/1.1 200 OK\r\nContent-Length: " +
+				strconv.Itoa(len(body)) + "\r\n\r\n" + body
+		})
+		cfg := Config{Host: host, Parser: JSONParser{}}
+		if err := SyncConfig(cfg, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if d := Now().Sub(date); d < 0 || d > time.Second {
+			t.Fatalf("expected %v, got %v", date, Now())
+		}
+		if Uncertainty() >= time.Second {
+			t.Fatalf("expected sub-second uncertainty, got %v", Uncertainty())
+		}
+	}
+}
+
+func TestWaitSynced(t *testing.T) {
+	defer Reset()
+	Reset()
+	if err := WaitSynced(time.Millisecond * 10); err != ErrNotSynced {
+		t.Fatalf("expected ErrNotSynced, got %v", err)
+	}
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	done := make(chan error)
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		done <- SyncSource(testSource(date), time.Second)
+	}()
+	if err := WaitSynced(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !IsSynced() {
+		t.Fatal("expected synced")
+	}
+	if err := WaitSynced(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetOffsetFromTime(t *testing.T) {
+	defer Reset()
+	Reset()
+	date := time.Now().Add(time.Hour)
+	if err := SetOffsetFromTime(date); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSynced() {
+		t.Fatal("expected synced")
+	}
+	if d := Now().Sub(date); d < 0 || d > time.Second {
+		t.Fatalf("expected %v, got %v", date, Now())
+	}
+	if d := Offset() - time.Hour; d < -time.Second || d > time.Second {
+		t.Fatalf("expected an offset of 1h, got %v", Offset())
+	}
+	err := SetOffsetFromTime(time.Now().Add(time.Hour * 48))
+	if !errors.Is(err, ErrMaxSkew) {
+		t.Fatalf("expected %v, got %v", ErrMaxSkew, err)
+	}
+}
+
+// testStallServer starts a local server that writes the prefix of a
+// response, followed by the filler at every interval until the connection is
+// closed. Returns the "host:port" of the server.
+func testStallServer(t *testing.T, prefix, filler string,
+	interval time.Duration) string {
+	return testConnServer(t, func(c net.Conn) {
+		io.WriteString(c, prefix)
+		for {
+			time.Sleep(interval)
+			if _, err := io.WriteString(c, filler); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestStallTimeout(t *testing.T) {
+	host := testStallServer(t, "HTTP/1.1 404 Not Found\r\n", "X: y\r\n",
+		time.Second)
+	start := time.Now()
+	err := SyncConfig(Config{Host: host, StallTimeout: time.Millisecond * 50},
+		time.Second*5)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the stall to be detected, took %v", elapsed)
+	}
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+	host := testStallServer(t, "HTTP/1.1 404 Not Found\r\n",
+		strings.Repeat("X: y\r\n", 100), time.Millisecond)
+	err := SyncHost(host, time.Second*5)
+	if !errors.Is(err, errHeaderTooLarge) {
+		t.Fatalf("expected errHeaderTooLarge, got %v", err)
+	}
+}
+
+func TestNowRounded(t *testing.T) {
+	defer Reset()
+	defer KeepUTC(false)
+	date := time.Now().Add(time.Hour).Truncate(time.Minute).
+		Add(time.Second * 20)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if now := NowRounded(time.Minute); !now.Equal(date.Truncate(time.Minute)) {
+		t.Fatalf("expected %v, got %v", date.Truncate(time.Minute), now)
+	}
+	KeepUTC(true)
+	if now := NowRounded(time.Minute); now.Location() != time.UTC {
+		t.Fatalf("expected UTC, got %v", now.Location())
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	defer Reset()
+	defer SetMaxAge(0)
+	nano := time.Hour
+	nanotime = func() time.Duration { return nano }
+	defer func() { nanotime = runtimeNano }()
+	SetMaxAge(time.Minute)
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	nano += time.Minute
+	if _, err := NowErr(); err != nil {
+		t.Fatal(err)
+	}
+	nano += time.Nanosecond
+	if _, err := NowErr(); err != ErrStale {
+		t.Fatalf("expected ErrStale, got %v", err)
+	}
+	for i, now := range []func() time.Time{Now, NowMono} {
+		func() {
+			defer func() {
+				if v := recover(); v != ErrStale {
+					t.Fatalf("now %d: expected ErrStale panic, got %v", i, v)
+				}
+			}()
+			now()
+		}()
+	}
+	if err := SyncSource(testSource(date), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NowErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentSyncNow(t *testing.T) {
+	host := testServer(t, func() time.Time { return time.Now().Add(time.Hour) })
+	c := New(Config{Host: host})
+	c.SmoothOffset(true)
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	errs := make(chan error, 16)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				// let the syncs run on machines with a single cpu.
+				runtime.Gosched()
+				now, err := c.NowErr()
+				if err == ErrNotSynced {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				expect := time.Now().Add(time.Hour)
+				if d := now.Sub(expect); d < -time.Second*2 ||
+					d > time.Second*2 {
+					errs <- errors.New("inconsistent time " + now.String())
+					return
+				}
+				c.IsSynced()
+				c.Offset()
+				c.Stats()
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.Sync(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		c.UnixNano()
+		if i%5 == 4 {
+			c.Reset()
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncVia(t *testing.T) {
+	defer Reset()
+	srv := testTimeServer(t, time.Now)
+	if err := SyncVia(srv.Addr, "example.com", time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if host := srv.Requests()[0].Header.Get("Host"); host != "example.com" {
+		t.Fatalf("expected example.com host, got %q", host)
+	}
+}
+
+func TestGoogleTime(t *testing.T) {
+	defer Reset()
+	Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	SetHost(testServer(t, func() time.Time { return date }))
+	defer SetHost("")
+	now, err := GoogleTime(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := now.Sub(date); d < 0 || d > time.Second {
+		t.Fatalf("expected %v, got %v", date, now)
+	}
+	if IsSynced() {
+		t.Fatal("expected not synced")
+	}
+}
+
+func TestMustSyncEvery(t *testing.T) {
+	defer Reset()
+	SetMinInterval(0)
+	defer SetMinInterval(time.Second)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	SetHost(dead.Addr().String())
+	defer SetHost("")
+	failed := Stats().Failed
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		MustSyncEvery(time.Millisecond*200, time.Millisecond*300)
+	}()
+	// the attempts at 0ms and 200ms, with no attempt after the timeout.
+	if n := Stats().Failed - failed; n != 2 {
+		t.Fatalf("expected 2 attempts, got %d", n)
+	}
+	// a long interval does not overshoot a short timeout.
+	failed = Stats().Failed
+	start := time.Now()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		MustSyncEvery(time.Second*2, time.Millisecond*100)
+	}()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout overshot by %v", elapsed-time.Millisecond*100)
+	}
+	if n := Stats().Failed - failed; n != 1 {
+		t.Fatalf("expected 1 attempt, got %d", n)
+	}
+}
+
+func TestMetadataSource(t *testing.T) {
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := testTimeServer(t, func() time.Time { return date })
+	src := MetadataSource{Cloud: "gcp", Host: srv.Addr}
+	now, err := src.Fetch(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := now.Sub(date); d < 0 || d > time.Second {
+		t.Fatalf("expected %v, got %v", date, now)
+	}
+	req := srv.Requests()[0]
+	if req.Method != "HEAD" || req.Path != "/computeMetadata/v1/" ||
+		req.Header.Get("Metadata-Flavor") != "Google" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if _, err := (MetadataSource{Cloud: "moon"}).Fetch(time.Second); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestPreciseOffset(t *testing.T) {
+	defer Reset()
+	SetMinInterval(0)
+	defer SetMinInterval(time.Second)
+	offset := time.Hour + time.Millisecond*370
+	SetHost(testServer(t, func() time.Time { return time.Now().Add(offset) }))
+	defer SetHost("")
+	var offsets, errs []time.Duration
+	for i := 0; i < 2; i++ {
+		// each sample halves the uncertainty of the previous ones.
+		if err := SyncPrecise(5, time.Second*10); err != nil {
+			t.Fatal(err)
+		}
+		u := Uncertainty()
+		if u > time.Millisecond*50 {
+			t.Fatalf("expected sub-second uncertainty, got %v", u)
+		}
+		// allow for the round trip of the local server.
+		u += time.Millisecond * 5
+		if d := Offset() - offset; d < -u || d > u {
+			t.Fatalf("expected an offset of %v, got %v", offset, Offset())
+		}
+		offsets, errs = append(offsets, Offset()), append(errs, u)
+	}
+	if d, u := offsets[1]-offsets[0], errs[0]+errs[1]; d < -u || d > u {
+		t.Fatalf("expected stable offsets, got %v", offsets)
+	}
+	// the sub-second part of the offset is applied by Now.
+	now, local := NowBoth()
+	if d := now.Sub(local) - Offset(); d < -time.Millisecond ||
+		d > time.Millisecond {
+		t.Fatalf("expected %v between synced and local time, got %v",
+			Offset(), now.Sub(local))
+	}
+}
+
+func TestMustSyncResult(t *testing.T) {
+	defer Reset()
+	SetMinInterval(0)
+	defer SetMinInterval(time.Second)
+	var n atomic.Int32
+	date := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	SetHost(testRawServer(t, func() string {
+		if n.Add(1) <= 2 {
+			// fails both the HTTP/1.1 and the HTTP/1.0 requests.
+			return "HTTP/1.1 404 Not Found\r\n\r\n"
+		}
+		return "HTTP/1.1 404 Not Found\r\nDate: " +
+			date.Format(http.TimeFormat) + "\r\n\r\n"
+	}))
+	defer SetHost("")
+	res := MustSyncResult(time.Second * 5)
+	if res.Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", res.Attempts)
+	}
+	if res.Offset != Offset() || res.RTT != LastRTT() ||
+		res.Uncertainty != Uncertainty() {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res.Elapsed < defaultRetryInterval {
+		t.Fatalf("expected at least %v, got %v", defaultRetryInterval,
+			res.Elapsed)
+	}
+}
+
+func TestSetValidator(t *testing.T) {
+	defer Reset()
+	defer SetValidator(nil)
+	errFuture := errors.New("too far in the future")
+	SetValidator(func(serverTime, localTime time.Time) error {
+		if serverTime.Sub(localTime) > time.Minute {
+			return errFuture
+		}
+		return nil
+	})
+	Reset()
+	err := SyncSource(testSource(time.Now().Add(time.Hour)), time.Second)
+	if !errors.Is(err, errFuture) {
+		t.Fatalf("expected %v, got %v", errFuture, err)
+	}
+	if IsSynced() {
+		t.Fatal("expected not synced")
+	}
+	err = SyncSource(testSource(time.Now().Add(time.Second)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoSyncPause(t *testing.T) {
+	defer Reset()
+	defer SetHost("")
+	defer SetMinInterval(time.Second)
+	Reset()
+	SetMinInterval(0)
+	var n atomic.Int32
+	date := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	SetHost(testRawServer(t, func() string {
+		n.Add(1)
+		return "HTTP/1.1 404 Not Found\r\nDate: " +
+			date.Format(http.TimeFormat) + "\r\n\r\n"
+	}))
+	a := StartAutoSyncController(time.Millisecond*10, AutoSyncOptions{})
+	defer a.Stop()
+	a.Pause()
+	if !a.Paused() {
+		t.Fatal("expected paused")
+	}
+	time.Sleep(time.Millisecond * 100)
+	if n := n.Load(); n != 0 {
+		t.Fatalf("expected no syncs while paused, got %d", n)
+	}
+	synced, unsubscribe := SyncNotify()
+	defer unsubscribe()
+	a.Resume()
+	select {
+	case <-synced:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected a sync")
+	}
+}
+
+func TestLastRemoteAddr(t *testing.T) {
+	defer Reset()
+	host := testServer(t, time.Now)
+	if err := SyncHost(host, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if addr := LastRemoteAddr(); addr != host {
+		t.Fatalf("expected %s, got %s", host, addr)
+	}
+	Reset()
+	if addr := LastRemoteAddr(); addr != "" {
+		t.Fatalf("expected no address, got %s", addr)
+	}
+}
+
+func TestJSONSource(t *testing.T) {
+	defer Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	host := testRawServer(t, func() string {
+		body := `{"unixtime":` + strconv.FormatInt(date.UnixMilli(), 10)[:10] +
+			"." + strconv.FormatInt(date.UnixMilli(), 10)[10:] + `}`
+		return "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	})
+	src := JSONSource{URL: "http://" + host + "/api/time", Field: "unixtime"}
+	if err := SyncSource(src, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := Now().Sub(date); d < 0 || d > time.Second {
+		t.Fatalf("expected %v, got %v", date, Now())
+	}
+	if LastRTT() <= 0 {
+		t.Fatalf("expected a round-trip time, got %v", LastRTT())
+	}
+	_, err := (JSONSource{URL: "ftp://" + host}).Fetch(time.Second)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestMinIntervalInFlight(t *testing.T) {
+	defer Reset()
+	Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := testTimeServer(t, nil)
+	srv.SetResponse(func() string {
+		time.Sleep(time.Millisecond * 200)
+		return gtimetest.Response(date)
+	})
+	SetHost(srv.Addr)
+	defer SetHost("")
+	first := make(chan error)
+	go func() { first <- Sync(time.Second * 5) }()
+	for srv.Conns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := Sync(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSynced() {
+		t.Fatal("expected synced")
+	}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Conns(); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestMinIntervalFailure(t *testing.T) {
+	defer Reset()
+	Reset()
+	date := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := testTimeServer(t, func() time.Time { return date })
+	SetHost(srv.Addr)
+	defer SetHost("")
+	// a failed sync, due to the timeout of the caller, is not reused.
+	if err := Sync(0); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := Sync(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSynced() {
+		t.Fatal("expected synced")
+	}
+	// a successful sync is reused within the minimum interval.
+	n := srv.Conns()
+	if err := Sync(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Conns() != n {
+		t.Fatal("expected no connection")
+	}
+}
+
+func TestSyncRetry(t *testing.T) {
+	defer Reset()
+	srv := testTimeServer(t, nil)
+	// fails both the HTTP/1.1 and the HTTP/1.0 request of each attempt.
+	srv.SetResponse(func() string { return "HTTP/1.1 404 Not Found\r\n\r\n" })
+	SetHost(srv.Addr)
+	defer SetHost("")
+	if err := SyncRetry(5, time.Millisecond*10, time.Second*5); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := srv.Conns(); n != 10 {
+		t.Fatalf("expected 10 connections, got %d", n)
+	}
+}
+
+func TestTrySync(t *testing.T) {
+	defer Reset()
+	srv := testTimeServer(t, nil)
+	srv.SetResponse(func() string { return "HTTP/1.1 404 Not Found\r\n\r\n" })
+	SetHost(srv.Addr)
+	defer SetHost("")
+	if TrySync(time.Millisecond * 300) {
+		t.Fatal("expected a failure")
+	}
+	// an attempt every 50ms, each with an HTTP/1.0 fallback.
+	if n := srv.Conns(); n < 8 {
+		t.Fatalf("expected at least 8 connections, got %d", n)
+	}
+	srv.SetNow(time.Now)
+	if err := Sync(time.Second * 5); err != nil {
+		t.Fatal(err)
+	}
+	// the retries are not limited by the minimum interval.
+	n := srv.Conns()
+	if !TrySync(time.Second * 5) {
+		t.Fatal("expected a success")
+	}
+	if srv.Conns() != n+1 {
+		t.Fatal("expected a connection")
+	}
+}
+
+func TestAutoSyncInterval(t *testing.T) {
+	for _, start := range []func(){
+		func() { StartAutoSync(0) },
+		func() { StartAutoSyncContext(context.Background(), -time.Second) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected a panic")
+				}
+			}()
+			start()
+		}()
+	}
+}
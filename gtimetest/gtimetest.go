@@ -0,0 +1,170 @@
+// Package gtimetest provides a local HTTP server for testing code that syncs
+// with gtime, without depending on the network.
+//
+//	srv := gtimetest.NewServer(gtimetest.Offset(time.Hour))
+//	defer srv.Close()
+//	gtime.SyncHost(srv.Addr, time.Second)
+package gtimetest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a minimal HTTP server that responds to every request with a
+// controllable response, and then closes the connection.
+type Server struct {
+	// Addr is the "host:port" of the server, which can be passed to
+	// gtime.SyncHost.
+	Addr string
+
+	ln    net.Listener
+	mu    sync.Mutex
+	resp  func() string
+	conns int
+	reqs  []Request
+}
+
+// Request is a request that was received by the server.
+type Request struct {
+	Method string      // such as "HEAD"
+	Path   string      // such as "/"
+	Proto  string      // such as "HTTP/1.1"
+	Header http.Header // header fields, including Host
+}
+
+// NewServer starts a server that responds with a Date header using the time
+// returned by now. A nil now uses time.Now.
+func NewServer(now func() time.Time) *Server {
+	srv := NewRawServer(nil)
+	srv.SetNow(now)
+	return srv
+}
+
+// NewRawServer starts a server that responds with the raw response returned
+// by resp, which allows for simulating malformed responses. For example:
+//
+//	gtimetest.NewRawServer(func() string {
+//		return "HTTP/1.1 404 Not Found\r\n\r\n"
+//	})
+func NewRawServer(resp func() string) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if ln, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("gtimetest: failed to listen: " + err.Error())
+		}
+	}
+	srv := &Server{Addr: ln.Addr().String(), ln: ln, resp: resp}
+	go srv.serve()
+	return srv
+}
+
+// SetNow changes the time that is used for the Date header. A nil now uses
+// time.Now.
+func (srv *Server) SetNow(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	srv.SetResponse(func() string {
+		return Response(now())
+	})
+}
+
+// SetResponse changes the raw response.
+func (srv *Server) SetResponse(resp func() string) {
+	srv.mu.Lock()
+	srv.resp = resp
+	srv.mu.Unlock()
+}
+
+// Conns returns the number of connections that the server has accepted,
+// which is zero when nothing has connected to the server.
+func (srv *Server) Conns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.conns
+}
+
+// Requests returns the requests that the server has received, in the order
+// received.
+func (srv *Server) Requests() []Request {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]Request(nil), srv.reqs...)
+}
+
+// Close stops the server.
+func (srv *Server) Close() error {
+	return srv.ln.Close()
+}
+
+func (srv *Server) serve() {
+	for {
+		c, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns++
+		srv.mu.Unlock()
+		go func() {
+			defer c.Close()
+			req, err := readRequest(c)
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.reqs = append(srv.reqs, req)
+			resp := srv.resp
+			srv.mu.Unlock()
+			io.WriteString(c, resp())
+		}()
+	}
+}
+
+// readRequest reads the request line and the header of a request. The
+// request line is not validated, allowing for any path.
+func readRequest(c net.Conn) (Request, error) {
+	tp := textproto.NewReader(bufio.NewReader(c))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return Request{}, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return Request{}, err
+	}
+	var req Request
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		req.Method = fields[0]
+	}
+	if len(fields) > 1 {
+		req.Path = fields[1]
+	}
+	if len(fields) > 2 {
+		req.Proto = fields[2]
+	}
+	req.Header = http.Header(header)
+	return req, nil
+}
+
+// Response returns a minimal response with a Date header for the time.
+func Response(t time.Time) string {
+	return "HTTP/1.0 404 Not Found\r\n" +
+		"Date: " + t.UTC().Format(http.TimeFormat) + "\r\n\r\n"
+}
+
+// Offset returns a function that returns the current time plus the offset,
+// which simulates a server that is skewed from the local system clock.
+func Offset(offset time.Duration) func() time.Time {
+	return func() time.Time {
+		return time.Now().Add(offset)
+	}
+}
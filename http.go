@@ -0,0 +1,413 @@
+package gtime
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverConn is a connection to an HTTP server.
+type serverConn struct {
+	net.Conn
+	ctx    context.Context
+	host   string
+	rtime  time.Duration // read timeout, see Config.ReadTimeout
+	stall  time.Duration // timeout of each read, see Config.StallTimeout
+	dtime  time.Time     // deadline of the request, if any
+	begin  time.Time     // when the connection was started
+	stop   func() bool   // stops watching the context
+	br     *bufio.Reader // buffers the bytes read past the last response header
+	lr     *limitedReader
+	closed bool          // the server closes the connection after a response
+	ttl    time.Duration // caches the address upon success, see Config.DNSCacheTTL
+	cached bool          // the connection uses a cached address
+	parser Parser        // parses the body, see Config.Parser
+}
+
+// dialServer connects to the server.
+func dialServer(ctx context.Context, cfg *Config) (_ *serverConn, err error) {
+	host := cfg.host()
+	op, begin := "dial", time.Now()
+	defer func() {
+		if err != nil {
+			err = &SyncError{Op: op, Host: host, Elapsed: time.Since(begin),
+				Err: canceled(ctx, err)}
+		}
+	}()
+	// connect to the host, which by default is the public google.com on
+	// port 80. This should resolve globally keeping the hops down regardless
+	// of where in the world we are.
+	addr := host
+	proxy, err := cfg.proxy(host)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		addr = hostPort(proxy.Host, "80")
+	}
+	var c net.Conn
+	var cached bool
+	if proxy == nil && cfg.DNSCacheTTL > 0 {
+		if caddr, ok := cachedAddr(host); ok {
+			logf("dialing %s (cached for %s)", caddr, host)
+			c, err = cfg.dial(ctx, cfg.network(), caddr)
+			if err != nil {
+				// the address stopped working, resolve the host again.
+				uncacheAddr(host)
+				if ctx.Err() != nil {
+					return nil, err
+				}
+			}
+			cached = err == nil
+		}
+	}
+	if c == nil {
+		logf("dialing %s", addr)
+		c, err = cfg.dial(ctx, cfg.network(), addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stop, err := watch(ctx, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	sc := &serverConn{Conn: c, ctx: ctx, host: host, rtime: cfg.ReadTimeout,
+		stall: cfg.StallTimeout, begin: begin, stop: stop, cached: cached,
+		parser: cfg.Parser}
+	if proxy == nil {
+		sc.ttl = cfg.DNSCacheTTL
+	}
+	if proxy != nil {
+		op = "proxy"
+		if err = connect(c, host, proxy); err != nil {
+			sc.Close()
+			return nil, err
+		}
+	}
+	if config := cfg.TLSConfig; config != nil {
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(host)
+		}
+		op = "handshake"
+		tc := tls.Client(c, config)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			sc.Close()
+			return nil, err
+		}
+		sc.Conn = tc
+	}
+	return sc, nil
+}
+
+// Close stops watching the context and closes the connection.
+func (c *serverConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// Read reads from the connection, limiting the time of the read to the stall
+// timeout.
+func (c *serverConn) Read(p []byte) (int, error) {
+	if c.stall > 0 {
+		deadline := time.Now().Add(c.stall)
+		if !c.dtime.IsZero() && c.dtime.Before(deadline) {
+			deadline = c.dtime
+		}
+		if err := c.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		// the context may be done prior to setting the deadline, which
+		// would otherwise override the interruption.
+		if err := c.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+// fetch sends the request to the server and returns the time from the Date
+// header of the response.
+func (c *serverConn) fetch(req string) (s sample, err error) {
+	op := "write"
+	defer func() {
+		if err != nil {
+			if c.cached {
+				uncacheAddr(c.host)
+			}
+			err = &SyncError{Op: op, Host: c.host,
+				Elapsed: time.Since(c.begin), Err: canceled(c.ctx, err)}
+		} else if c.ttl > 0 && !c.cached {
+			cacheAddr(c.host, c.RemoteAddr(), c.ttl)
+		}
+	}()
+	c.dtime, _ = c.ctx.Deadline()
+	if c.rtime > 0 {
+		deadline := time.Now().Add(c.rtime)
+		if !c.dtime.IsZero() && c.dtime.Before(deadline) {
+			deadline = c.dtime
+		}
+		c.dtime = deadline
+		if err = c.SetDeadline(deadline); err != nil {
+			return sample{}, err
+		}
+		// the context may be done prior to setting the deadline, which
+		// would otherwise override the interruption.
+		if err = c.ctx.Err(); err != nil {
+			return sample{}, err
+		}
+	}
+	start := nanotime()
+	if _, err = io.WriteString(c, req); err != nil {
+		return sample{}, err
+	}
+	op = "read"
+	status, header, err := c.readHeader(&s)
+	if err != nil {
+		return sample{}, err
+	}
+	s.rtt = s.nano - start
+	s.addr = c.RemoteAddr().String()
+	logf("read %q from %s", status, c.host)
+	var body []byte
+	if c.parser != nil {
+		if body, err = c.readBody(header); err != nil {
+			return sample{}, err
+		}
+	}
+	op = "parse"
+	if fields := strings.Fields(status); len(fields) > 1 {
+		s.status, _ = strconv.Atoi(fields[1])
+	}
+	conn := header.Get("Connection")
+	if strings.HasPrefix(status, "HTTP/1.0") {
+		c.closed = c.closed || !strings.EqualFold(conn, "keep-alive")
+	} else {
+		c.closed = c.closed || strings.EqualFold(conn, "close")
+	}
+	var t time.Time
+	if c.parser != nil {
+		if t, err = c.parser.Parse(body); err != nil {
+			return sample{}, err
+		}
+		logf("parsed time %v from %s", t, c.host)
+	} else {
+		dts := header.Get("Date")
+		if dts == "" {
+			return sample{}, ErrNoDateHeader
+		}
+		if t, err = parseDate(dts); err != nil {
+			return sample{}, err
+		}
+		logf("parsed date %q from %s", dts, c.host)
+	}
+	// the server most likely generated the date somewhere in the middle of
+	// the round trip, so it's assumed that half of the round trip time has
+	// elapsed since then.
+	s.date = t.Local()
+	s.t = s.date.Add(s.rtt / 2)
+	s.err = s.rtt / 2
+	if t.Nanosecond() == 0 {
+		// the date is truncated to the second.
+		s.err += time.Second
+	}
+	return s, nil
+}
+
+// errBodyTooLarge is returned when the response body exceeds maxBodySize.
+var errBodyTooLarge = errors.New("response body too large")
+
+// readBody reads the body of the response, which is either delimited by the
+// Content-Length header, chunked, or ends when the server closes the
+// connection.
+func (c *serverConn) readBody(header textproto.MIMEHeader) ([]byte, error) {
+	// leave room for the framing of the chunks.
+	c.lr.n = maxHeaderSize + maxBodySize
+	var r io.Reader = c.br
+	chunked := strings.EqualFold(header.Get("Transfer-Encoding"), "chunked")
+	n := int64(-1)
+	switch {
+	case chunked:
+		r = httputil.NewChunkedReader(c.br)
+	case header.Get("Content-Length") != "":
+		var err error
+		n, err = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid content length")
+		}
+		if n > maxBodySize {
+			return nil, errBodyTooLarge
+		}
+		r = io.LimitReader(c.br, n)
+	default:
+		c.closed = true
+	}
+	body, err := io.ReadAll(io.LimitReader(r, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodySize {
+		return nil, errBodyTooLarge
+	}
+	if n >= 0 && int64(len(body)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if chunked {
+		// skip the trailer, leaving the connection ready for the next
+		// response.
+		if _, err := textproto.NewReader(c.br).ReadMIMEHeader(); err != nil &&
+			err != io.EOF {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// readHeader reads the status line and the header of the response. The
+// moment that the first bytes of the response arrive is recorded in the
+// sample.
+func (c *serverConn) readHeader(s *sample,
+) (string, textproto.MIMEHeader, error) {
+	if c.br == nil {
+		c.lr = &limitedReader{r: c}
+		c.br = bufio.NewReader(c.lr)
+	}
+	c.lr.n = maxHeaderSize
+	if _, err := c.br.Peek(1); err != nil {
+		return "", nil, err
+	}
+	// get our server clock upon receiving the first bytes of the response.
+	// This value will be used as the seed to sync against for all following
+	// Now calls.
+	s.nano = nanotime()
+	s.local = time.Now()
+	tp := textproto.NewReader(c.br)
+	status, err := tp.ReadLine()
+	if err != nil {
+		return "", nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the server closed the connection without ending the header.
+		c.closed = true
+		err = nil
+	}
+	return status, header, err
+}
+
+// errHeaderTooLarge is returned when the response header exceeds
+// maxHeaderSize.
+var errHeaderTooLarge = errors.New("response header too large")
+
+// limitedReader reads from r until n bytes have been read, after which
+// errHeaderTooLarge is returned.
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if len(p) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= n
+	return n, err
+}
+
+// keepAliveConn fetches the time from the server over a single keep-alive
+// connection, reconnecting when the server closes the connection.
+type keepAliveConn struct {
+	ctx context.Context
+	cfg *Config
+	c   *serverConn
+}
+
+// fetch sends a keep-alive request to the server.
+func (kc *keepAliveConn) fetch() (sample, error) {
+	req := kc.cfg.request(true)
+	reused := kc.c != nil
+	if kc.c == nil {
+		var err error
+		if kc.c, err = dialServer(kc.ctx, kc.cfg); err != nil {
+			return sample{}, err
+		}
+	}
+	s, err := kc.c.fetch(req)
+	if err != nil && reused && kc.ctx.Err() == nil {
+		// the server may have closed the idle connection.
+		kc.c.Close()
+		if kc.c, err = dialServer(kc.ctx, kc.cfg); err != nil {
+			return sample{}, err
+		}
+		s, err = kc.c.fetch(req)
+	}
+	if err != nil || kc.c.closed {
+		kc.Close()
+	}
+	return s, err
+}
+
+// Close closes the connection, if any.
+func (kc *keepAliveConn) Close() {
+	if kc.c != nil {
+		kc.c.Close()
+		kc.c = nil
+	}
+}
+
+// getNow fetches the time from the server. The request is sent again using
+// HTTP/1.0 when the server fails the HTTP/1.1 request.
+func getNow(ctx context.Context, cfg *Config) (sample, error) {
+	s, err := getNowRequest(ctx, cfg, cfg.request(false))
+	var serr *SyncError
+	if err != nil && ctx.Err() == nil && errors.As(err, &serr) &&
+		(serr.Op == "write" || serr.Op == "read" || serr.Op == "parse") {
+		logf("falling back to HTTP/1.0: %v", err)
+		s, err = getNowRequest(ctx, cfg, cfg.legacyRequest())
+	}
+	return s, err
+}
+
+// getNowRequest fetches the time from the server using the request.
+func getNowRequest(ctx context.Context, cfg *Config, req string,
+) (sample, error) {
+	c, err := dialServer(ctx, cfg)
+	if err != nil {
+		return sample{}, err
+	}
+	defer c.Close()
+	return c.fetch(req)
+}
+
+// dateLayouts are the formats that are allowed for the HTTP Date header.
+// RFC 7231 requires the IMF-fixdate format, RFC1123, but also allows the
+// obsolete RFC850 and ANSIC formats. Some servers use a numeric zone.
+var dateLayouts = []string{
+	time.RFC1123, time.RFC1123Z, time.RFC850, time.ANSIC,
+}
+
+// parseDate parses the value of an HTTP Date header.
+func parseDate(dts string) (time.Time, error) {
+	var err error
+	for _, layout := range dateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, dts); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
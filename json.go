@@ -0,0 +1,57 @@
+package gtime
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// JSONSource is a Source that fetches the time from a JSON time API over
+// HTTP or HTTPS, such as worldtimeapi.org, using a GET request for the URL.
+// The response is parsed using a JSONParser. This allows for syncing in
+// environments that only allow for web requests.
+type JSONSource struct {
+	// URL is the "http" or "https" URL of the API, such as
+	// "https://worldtimeapi.org/api/timezone/Etc/UTC".
+	URL string
+	// Field is the field of the response that has the time, see
+	// JSONParser.Field.
+	Field string
+	// Layout is the format of the time, see JSONParser.Layout.
+	Layout string
+	// Proxy is the HTTP proxy to use, see Config.Proxy.
+	Proxy func(target *url.URL) (*url.URL, error)
+}
+
+// Fetch returns the current time from the API.
+func (src JSONSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return fetch(src, timeout)
+}
+
+// sample fetches the time from the API, see sampler.
+func (src JSONSource) sample(timeout time.Duration) (sample, error) {
+	cfg, err := src.config()
+	if err != nil {
+		return sample{}, err
+	}
+	return getNowTimeout(&cfg, timeout)
+}
+
+// config returns the config for fetching the time from the URL.
+func (src JSONSource) config() (Config, error) {
+	u, err := url.Parse(src.URL)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{Host: u.Host, Path: u.RequestURI(), Proxy: src.Proxy,
+		Parser: JSONParser{Field: src.Field, Layout: src.Layout}}
+	switch u.Scheme {
+	case "http":
+	case "https":
+		cfg.TLSConfig = &tls.Config{}
+	default:
+		return Config{}, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,66 @@
+package gtime
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// metadataHost is the link-local address of the instance metadata service,
+// which is the same for AWS, GCP, and Azure.
+const metadataHost = "169.254.169.254:80"
+
+// MetadataSource is a Source that fetches the time from the Date header of
+// the instance metadata service of a cloud provider. The metadata service is
+// on the local link of the instance, so it has a low latency and works
+// without outbound internet access.
+type MetadataSource struct {
+	// Cloud is the cloud provider, which is "aws", "gcp", or "azure". The
+	// request is adjusted to what the metadata service of the provider
+	// expects. Defaults to a request that is accepted by all of them.
+	Cloud string
+	// Host is the "host:port" of the metadata service. Defaults to
+	// "169.254.169.254:80".
+	Host string
+}
+
+// Fetch returns the current time from the metadata service.
+func (src MetadataSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return fetch(src, timeout)
+}
+
+// sample fetches the time from the metadata service, see sampler.
+func (src MetadataSource) sample(timeout time.Duration) (sample, error) {
+	cfg, err := src.config()
+	if err != nil {
+		return sample{}, err
+	}
+	return getNowTimeout(&cfg, timeout)
+}
+
+// config returns the config for fetching the time from the metadata service
+// of the cloud.
+func (src MetadataSource) config() (Config, error) {
+	cfg := Config{Host: src.Host, Header: http.Header{}}
+	if cfg.Host == "" {
+		cfg.Host = metadataHost
+	}
+	switch src.Cloud {
+	case "":
+		cfg.Header.Set("Metadata-Flavor", "Google")
+		cfg.Header.Set("Metadata", "true")
+	case "aws":
+		// the response to a request without an IMDSv2 token is unauthorized,
+		// but it still has the Date header.
+		cfg.Path = "/latest/meta-data/"
+	case "gcp":
+		cfg.Path = "/computeMetadata/v1/"
+		cfg.Header.Set("Metadata-Flavor", "Google")
+	case "azure":
+		cfg.Path = "/metadata/instance?api-version=2021-02-01"
+		cfg.Header.Set("Metadata", "true")
+	default:
+		return Config{}, fmt.Errorf("unknown cloud %q", src.Cloud)
+	}
+	return cfg, nil
+}
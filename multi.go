@@ -0,0 +1,192 @@
+package gtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HostResult is the result of fetching the time from one of the hosts that
+// was provided to SyncMulti or SyncQuorum.
+type HostResult struct {
+	Host   string        // the host
+	Offset time.Duration // offset measured for the host
+	RTT    time.Duration // round-trip time of the request
+	Weight float64       // weight of the offset in the combined offset
+	Err    error         // non-nil if fetching the time failed
+}
+
+var (
+	gmultiMu sync.RWMutex
+	gmulti   []HostResult
+)
+
+// SyncMulti is like SyncHost but fetches the time from multiple hosts
+// concurrently and combines the offsets of all successful responses. This
+// guards against a single server with a bad clock or a slow network path.
+// Returns an error if fewer than a majority of the hosts respond. Hosts that
+// have not responded by the time a majority has, with offsets that agree,
+// are canceled.
+//
+// Offsets that disagree with the median offset by more than their
+// uncertainty are discarded, and the remaining offsets are weighted by the
+// inverse of their round-trip time, making servers that are near more
+// trustworthy than those that are far. Returns an error if none of the
+// offsets agree. Use LastMultiResults to audit the weighting.
+func SyncMulti(hosts []string, timeout time.Duration) error {
+	return SyncQuorum(hosts, len(hosts)/2+1, timeout)
+}
+
+// SyncQuorum is like SyncMulti but requires at least quorum successful
+// responses.
+func SyncQuorum(hosts []string, quorum int, timeout time.Duration) error {
+	return SyncQuorumTimeout(hosts, quorum, timeout, 0)
+}
+
+// SyncQuorumTimeout is like SyncQuorum but also limits the time spent on each
+// host to hostTimeout, which is in addition to the overall timeout. Zero or
+// less means that each host may take up to the overall timeout.
+func SyncQuorumTimeout(hosts []string, quorum int, timeout,
+	hostTimeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, results, err := getMulti(ctx, hosts, quorum, hostTimeout)
+	gmultiMu.Lock()
+	gmulti = results
+	gmultiMu.Unlock()
+	return commit(s, err)
+}
+
+// LastMultiResults returns the result for each host of the last SyncMulti or
+// SyncQuorum, in the same order as the hosts were provided.
+func LastMultiResults() []HostResult {
+	gmultiMu.RLock()
+	defer gmultiMu.RUnlock()
+	return append([]HostResult(nil), gmulti...)
+}
+
+// getMulti fetches the time from all hosts and returns a sample that has the
+// combined offset of all successful responses. The hosts that have not
+// responded are canceled as soon as the quorum is reached with offsets that
+// agree, or when the quorum can no longer be reached.
+func getMulti(ctx context.Context, hosts []string, quorum int,
+	hostTimeout time.Duration) (sample, []HostResult, error) {
+	if quorum < 1 {
+		quorum = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	samples := make([]sample, len(hosts))
+	results := make([]HostResult, len(hosts))
+	done := make(chan int, len(hosts))
+	for i, host := range hosts {
+		go func(i int, host string) {
+			ctx := ctx
+			if hostTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, hostTimeout)
+				defer cancel()
+			}
+			s, err := getNow(ctx, &Config{Host: host})
+			samples[i] = s
+			results[i] = HostResult{Host: host, Err: err}
+			if err == nil {
+				results[i].Offset, results[i].RTT = s.offset(), s.rtt
+			}
+			done <- i
+		}(i, host)
+	}
+	var ok []int
+	var failed int
+	for range hosts {
+		if i := <-done; results[i].Err == nil {
+			ok = append(ok, i)
+		} else {
+			failed++
+		}
+		// keep waiting past the quorum until the offsets agree, so that a
+		// single bad server in the quorum does not decide the median.
+		if len(ok) >= quorum && agreed(samples, ok) ||
+			len(hosts)-failed == quorum-1 {
+			cancel()
+		}
+	}
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	if len(ok) < quorum {
+		return sample{}, results, fmt.Errorf("quorum not reached: %d of %d "+
+			"hosts responded, %d required: %w", len(ok), len(hosts), quorum,
+			errors.Join(errs...))
+	}
+	median := medianOffset(samples, ok)
+	// weight each offset by the inverse of its round-trip time, discarding
+	// those that disagree with the median.
+	var sum, wsum float64
+	best := -1
+	for _, i := range ok {
+		s := samples[i]
+		if !s.agrees(median) {
+			continue
+		}
+		w := 1 / float64(max(s.rtt, time.Microsecond))
+		results[i].Weight = w
+		sum += w * float64(s.offset())
+		wsum += w
+		if best == -1 || s.rtt < samples[best].rtt {
+			best = i
+		}
+	}
+	if best == -1 {
+		return sample{}, results, fmt.Errorf("no agreement: none of the "+
+			"offsets of the %d hosts that responded agree with the median",
+			len(ok))
+	}
+	for i := range results {
+		results[i].Weight /= wsum
+	}
+	s := samples[best]
+	s.t = s.local.Add(time.Duration(sum / wsum))
+	return s, results, nil
+}
+
+// medianOffset sorts the indexes of the samples by offset and returns the
+// median offset.
+func medianOffset(samples []sample, ok []int) time.Duration {
+	sort.Slice(ok, func(i, j int) bool {
+		return samples[ok[i]].offset() < samples[ok[j]].offset()
+	})
+	median := samples[ok[len(ok)/2]].offset()
+	if len(ok)%2 == 0 {
+		median = (samples[ok[len(ok)/2-1]].offset() + median) / 2
+	}
+	return median
+}
+
+// agreed returns true if at least one of the offsets of the samples agrees
+// with their median offset.
+func agreed(samples []sample, ok []int) bool {
+	median := medianOffset(samples, ok)
+	for _, i := range ok {
+		if samples[i].agrees(median) {
+			return true
+		}
+	}
+	return false
+}
+
+// agrees returns true if the offset of the sample is within its uncertainty
+// of the median offset.
+func (s sample) agrees(median time.Duration) bool {
+	d := s.offset() - median
+	return d <= s.err && d >= -s.err
+}
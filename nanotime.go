@@ -0,0 +1,11 @@
+//go:build !purego
+
+package gtime
+
+import (
+	"time"
+	_ "unsafe"
+)
+
+//go:linkname runtimeNano runtime.nanotime
+func runtimeNano() time.Duration
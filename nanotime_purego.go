@@ -0,0 +1,14 @@
+//go:build purego
+
+package gtime
+
+import "time"
+
+// monoStart is the reference for the monotonic clock readings of runtimeNano.
+var monoStart = time.Now()
+
+// runtimeNano returns the monotonic clock reading from the time package, for
+// platforms and Go versions where linking to runtime.nanotime is not viable.
+func runtimeNano() time.Duration {
+	return time.Since(monoStart)
+}
@@ -0,0 +1,159 @@
+package gtime
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultNTPServer is the server used by SyncNTP when no server is provided.
+const defaultNTPServer = "time.google.com"
+
+// ntpEpoch is the NTP era 0 epoch, which is 1900-01-01 UTC.
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SyncNTP is like Sync but uses the NTP protocol to fetch the time from the
+// provided server. The server uses port 123 when a port is not provided, and
+// defaults to "time.google.com" when empty. NTP provides much better
+// precision than the Date header of an HTTP response.
+func SyncNTP(server string, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := getNTP(ctx, server)
+	return commit(s, err)
+}
+
+// SyncGoogleTime syncs using the best available path to Google time. It
+// first tries NTP using "time.google.com", which is Google's dedicated time
+// service, and falls back to the Date header of google.com over HTTPS and
+// then HTTP for networks that block NTP. The timeout applies to all
+// attempts combined, with NTP limited to half of the timeout.
+func SyncGoogleTime(timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// a blocked NTP request gets no response at all, so leave time for the
+	// fallbacks.
+	nctx, ncancel := context.WithTimeout(ctx, timeout/2)
+	s, err := getNTP(nctx, defaultNTPServer)
+	ncancel()
+	if err != nil && ctx.Err() == nil {
+		logf("falling back to https: %v", err)
+		s, err = getNow(ctx, &Config{TLSConfig: &tls.Config{}})
+	}
+	if err != nil && ctx.Err() == nil {
+		logf("falling back to http: %v", err)
+		s, err = getNow(ctx, &Config{})
+	}
+	return commit(s, err)
+}
+
+// NTPSource is a Source that fetches the time from an NTP server.
+type NTPSource struct {
+	// Server is the NTP server. Defaults to "time.google.com".
+	Server string
+}
+
+// Fetch returns the current time from the NTP server.
+func (src NTPSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return fetch(src, timeout)
+}
+
+// sample fetches the time from the NTP server, see sampler.
+func (src NTPSource) sample(timeout time.Duration) (sample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return getNTP(ctx, src.Server)
+}
+
+// getNTP fetches the time from the NTP server.
+func getNTP(ctx context.Context, server string) (s sample, err error) {
+	if server == "" {
+		server = defaultNTPServer
+	}
+	host := hostPort(server, "123")
+	op, begin := "dial", time.Now()
+	defer func() {
+		if err != nil {
+			err = &SyncError{Op: op, Host: host, Elapsed: time.Since(begin),
+				Err: canceled(ctx, err)}
+		}
+	}()
+	logf("dialing %s", host)
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return sample{}, err
+	}
+	defer c.Close()
+	stop, err := watch(ctx, c)
+	if err != nil {
+		return sample{}, err
+	}
+	defer stop()
+	// The request is a single 48 byte packet with the leap indicator set to
+	// zero, version number set to 4, and the mode set to 3 (client).
+	req := make([]byte, 48)
+	req[0] = 0<<6 | 4<<3 | 3
+	op = "write"
+	start := nanotime()
+	if _, err = c.Write(req); err != nil {
+		return sample{}, err
+	}
+	op = "read"
+	resp := make([]byte, 48)
+	n, err := c.Read(resp)
+	if err != nil {
+		return sample{}, err
+	}
+	s.nano = nanotime()
+	s.local = time.Now()
+	s.addr = c.RemoteAddr().String()
+	op = "parse"
+	if n < 48 {
+		return sample{}, errors.New("invalid ntp response")
+	}
+	switch {
+	case resp[0]&7 != 4:
+		return sample{}, errors.New("invalid ntp response mode")
+	case resp[0]>>6 == 3:
+		return sample{}, errors.New("ntp server is not synchronized")
+	case resp[1] == 0:
+		return sample{}, errors.New("ntp server sent kiss-of-death")
+	}
+	recv := ntpTime(resp[32:])
+	xmit := ntpTime(resp[40:])
+	// The round-trip delay excludes the time the server spent between
+	// receiving the request and transmitting the response.
+	s.rtt = s.nano - start - xmit.Sub(recv)
+	if s.rtt < 0 {
+		s.rtt = 0
+	}
+	logf("read ntp time %v from %s", xmit, host)
+	s.date = xmit.Local()
+	s.t = s.date.Add(s.rtt / 2)
+	s.err = s.rtt / 2
+	return s, nil
+}
+
+// ntpTime converts a 64-bit NTP timestamp, which contains the seconds since
+// the NTP epoch followed by the fraction of a second.
+func ntpTime(b []byte) time.Time {
+	secs := binary.BigEndian.Uint32(b)
+	frac := binary.BigEndian.Uint32(b[4:])
+	nsec := uint64(frac) * uint64(time.Second) >> 32
+	t := ntpEpoch
+	if secs&0x80000000 == 0 {
+		// era 1, which starts on 2036-02-07.
+		t = t.Add(1 << 32 * time.Second)
+	}
+	return t.Add(time.Duration(secs) * time.Second).Add(time.Duration(nsec))
+}
@@ -0,0 +1,62 @@
+package gtime
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testNTPServer starts a local NTP server that responds with the time
+// returned by now. Returns the "host:port" of the server.
+func testNTPServer(t *testing.T, now func() time.Time) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 48)
+		for {
+			_, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			b[0] = 0<<6 | 4<<3 | 4
+			b[1] = 1
+			d := now().Sub(ntpEpoch)
+			secs := uint64(d / time.Second)
+			frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+			binary.BigEndian.PutUint64(b[32:], secs<<32|frac)
+			binary.BigEndian.PutUint64(b[40:], secs<<32|frac)
+			pc.WriteTo(b, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestSyncNTP(t *testing.T) {
+	offset := time.Hour + time.Millisecond*300
+	server := testNTPServer(t, func() time.Time {
+		return time.Now().Add(offset)
+	})
+	if err := SyncNTP(server, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := Offset() - offset; d < -time.Millisecond*10 ||
+		d > time.Millisecond*10 {
+		t.Fatalf("offset is off by %v", d)
+	}
+}
+
+func TestNTPSource(t *testing.T) {
+	defer Reset()
+	server := testNTPServer(t, time.Now)
+	if err := SyncSource(NTPSource{server}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if rtt := LastRTT(); rtt <= 0 || Uncertainty() != rtt/2 {
+		t.Fatalf("unexpected uncertainty %v for rtt %v", Uncertainty(), rtt)
+	}
+}
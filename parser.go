@@ -0,0 +1,114 @@
+package gtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parser parses the time from the body of a response, see Config.Parser.
+// This allows for syncing with time APIs that report the time in the body
+// rather than in the Date header.
+type Parser interface {
+	Parse(b []byte) (time.Time, error)
+}
+
+// DateParser is a Parser for an HTTP-date, which is the format of the Date
+// header, such as "Mon, 02 Jan 2006 15:04:05 GMT".
+type DateParser struct{}
+
+// Parse parses the HTTP-date.
+func (DateParser) Parse(b []byte) (time.Time, error) {
+	return parseDate(string(bytes.TrimSpace(b)))
+}
+
+// JSONParser is a Parser for a JSON object that has the time in one of its
+// fields, such as the responses of worldtimeapi.org. The field is either a
+// string that is formatted using the layout, or a number of seconds since
+// the Unix epoch.
+type JSONParser struct {
+	// Field is the name of the field that has the time. Defaults to
+	// "utc_datetime".
+	Field string
+	// Layout is the format of the time when the field is a string, see
+	// time.Parse. Defaults to time.RFC3339Nano.
+	Layout string
+}
+
+// Parse parses the time from the field of the JSON object.
+func (p JSONParser) Parse(b []byte) (time.Time, error) {
+	field, layout := p.Field, p.Layout
+	if field == "" {
+		field = "utc_datetime"
+	}
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return time.Time{}, err
+	}
+	raw, ok := obj[field]
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing field %q", field)
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return time.Time{}, err
+	}
+	switch v := v.(type) {
+	case string:
+		return time.Parse(layout, v)
+	case json.Number:
+		return parseUnix(v.String())
+	}
+	return time.Time{}, fmt.Errorf("field %q is not a string or number",
+		field)
+}
+
+// parseUnix parses a decimal number of seconds since the Unix epoch without
+// losing the precision of the fraction, which a float64 would.
+func parseUnix(s string) (time.Time, error) {
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*1e9)), nil
+	}
+	secs, frac, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	if strings.Trim(frac, "0123456789") != "" {
+		return time.Time{}, errors.New("invalid unix time")
+	}
+	var nsec int64
+	if frac != "" {
+		nsec, _ = strconv.ParseInt(frac, 10, 64)
+		nsec *= int64(pow10(9 - len(frac)))
+		if strings.HasPrefix(secs, "-") {
+			nsec = -nsec
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// pow10 returns 10 to the power of n.
+func pow10(n int) int {
+	p := 1
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,83 @@
+package gtime
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ProxyURL returns a proxy function, for use in Config.Proxy, that always
+// returns the same URL.
+func ProxyURL(fixed *url.URL) func(*url.URL) (*url.URL, error) {
+	return func(*url.URL) (*url.URL, error) {
+		return fixed, nil
+	}
+}
+
+// ProxyFromEnvironment is a proxy function, for use in Config.Proxy, that
+// uses the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables.
+// It works the same as http.ProxyFromEnvironment.
+func ProxyFromEnvironment(target *url.URL) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: target})
+}
+
+// proxy returns the URL of the proxy for the host, or nil if the host should
+// be connected to directly.
+func (cfg *Config) proxy(host string) (*url.URL, error) {
+	if cfg.Proxy == nil {
+		return nil, nil
+	}
+	target := &url.URL{Scheme: "http", Host: host}
+	if cfg.TLSConfig != nil {
+		target.Scheme = "https"
+	}
+	proxy, err := cfg.Proxy(target)
+	if err != nil || proxy == nil {
+		return nil, err
+	}
+	if proxy.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	return proxy, nil
+}
+
+// connect asks the proxy on the other end of the connection to open a
+// tunnel to the host using the CONNECT method.
+func connect(c net.Conn, host string, proxy *url.URL) error {
+	req := "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n"
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString(
+			[]byte(u.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(c, req+"\r\n"); err != nil {
+		return err
+	}
+	// The response is read one byte at a time to avoid reading past the end
+	// of the response header, which belongs to the tunneled connection.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{c}, 16),
+		&http.Request{Method: "CONNECT"})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("proxy: " + resp.Status)
+	}
+	return nil
+}
+
+// byteReader reads at most one byte at a time.
+type byteReader struct{ r io.Reader }
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.r.Read(p)
+}
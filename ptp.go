@@ -0,0 +1,27 @@
+package gtime
+
+import "time"
+
+// defaultPTPDevice is the device used by PTPSource when no device is
+// provided.
+const defaultPTPDevice = "/dev/ptp0"
+
+// PTPSource is a Source that reads the time from a PTP hardware clock, which
+// is much more accurate than fetching the time over the network. Only
+// supported on Linux, other platforms return an error.
+type PTPSource struct {
+	// Device is the path of the PTP clock device. Defaults to "/dev/ptp0".
+	Device string
+	// Offset is added to the time of the clock. PTP clocks often run on TAI,
+	// which is ahead of UTC by the number of leap seconds, such as the
+	// default of ptp4l. Use -37 seconds for such clocks.
+	Offset time.Duration
+}
+
+// device returns the path of the PTP clock device.
+func (src PTPSource) device() string {
+	if src.Device == "" {
+		return defaultPTPDevice
+	}
+	return src.Device
+}
@@ -0,0 +1,30 @@
+package gtime
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Fetch returns the current time from the PTP clock. The timeout is not used
+// as reading the clock does not block.
+func (src PTPSource) Fetch(timeout time.Duration) (time.Time, error) {
+	f, err := os.Open(src.device())
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	// the clock id of a dynamic clock is derived from the file descriptor,
+	// see FD_TO_CLOCKID in the Linux source.
+	clockid := (^int(f.Fd()) << 3) | 3
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME,
+		uintptr(clockid), uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return time.Time{}, fmt.Errorf("clock_gettime %s: %w", src.device(),
+			errno)
+	}
+	return time.Unix(ts.Unix()).Add(src.Offset), nil
+}
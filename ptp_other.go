@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gtime
+
+import (
+	"errors"
+	"time"
+)
+
+// Fetch returns an error as PTP clocks are only supported on Linux.
+func (src PTPSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return time.Time{}, errors.New("ptp clocks are only supported on linux")
+}
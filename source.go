@@ -0,0 +1,120 @@
+package gtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Source is a provider of time that can be synced against using SyncSource.
+type Source interface {
+	// Fetch returns the current time according to the source. The returned
+	// time should be as close as possible to the moment that Fetch returns.
+	Fetch(timeout time.Duration) (time.Time, error)
+}
+
+// GoogleSource is the Source that is used by Sync.
+type GoogleSource struct{}
+
+// Fetch returns the current Google time.
+func (src GoogleSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return fetch(src, timeout)
+}
+
+// sample fetches the Google time, see sampler.
+func (GoogleSource) sample(timeout time.Duration) (sample, error) {
+	return getNowTimeout(&Config{}, timeout)
+}
+
+// HTTPSource is a Source that fetches the time from an HTTP server using the
+// provided config, see SyncConfig.
+type HTTPSource struct {
+	Config Config
+}
+
+// Fetch returns the current time from the HTTP server.
+func (src HTTPSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return fetch(src, timeout)
+}
+
+// sample fetches the time from the HTTP server, see sampler.
+func (src HTTPSource) sample(timeout time.Duration) (sample, error) {
+	return getNowTimeout(&src.Config, timeout)
+}
+
+// SyncSource is like Sync but uses the provided source instead of Google.
+func SyncSource(src Source, timeout time.Duration) error {
+	if std.forcedLocal() {
+		return nil
+	}
+	if src, ok := src.(sampler); ok {
+		return commit(src.sample(timeout))
+	}
+	t, err := src.Fetch(timeout)
+	return commit(sample{date: t, t: t, local: time.Now(), nano: nanotime()},
+		err)
+}
+
+// sampler is implemented by the built-in sources, which measure more than
+// the time, such as the round-trip time, which is kept by SyncSource.
+type sampler interface {
+	sample(timeout time.Duration) (sample, error)
+}
+
+// fetch returns the time of the sample at the moment that fetch returns,
+// which is how the samplers implement Fetch.
+func fetch(src sampler, timeout time.Duration) (time.Time, error) {
+	s, err := src.sample(timeout)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.t.Add(nanotime() - s.nano), nil
+}
+
+// getNowTimeout is like getNow but uses a timeout instead of a context.
+func getNowTimeout(cfg *Config, timeout time.Duration) (sample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return getNow(ctx, cfg)
+}
+
+// SetOffsetFromTime makes the provided time, which was obtained from a
+// trusted source by other means, the current time for all following Now
+// calls. The time is applied as if it had been fetched by a sync that
+// completed at this moment, so it should be as fresh as possible. Returns an
+// error when the time is rejected, such as by the max skew, see SetMaxSkew,
+// or by the validator, see SetValidator, which is counted as a failed sync.
+func SetOffsetFromTime(serverTime time.Time) error {
+	return std.SetOffsetFromTime(serverTime)
+}
+
+// SyncChain tries to sync with each of the sources in order, stopping at the
+// first success. The timeout applies to each source separately. Returns an
+// error that reports the failure of each source if all sources fail.
+func SyncChain(timeout time.Duration, sources ...Source) error {
+	if len(sources) == 0 {
+		return errors.New("no sources")
+	}
+	var errs []error
+	for i, src := range sources {
+		err := SyncSource(src, timeout)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("source %d (%T): %w", i, src, err))
+	}
+	return errors.Join(errs...)
+}
+
+// FakeSource is a Source that returns the time of a Clock. Combined with a
+// FakeClock this allows for syncing to a deterministic time without network
+// access. It's intended for testing.
+type FakeSource struct {
+	Clock Clock
+}
+
+// Fetch returns the current time of the clock.
+func (src FakeSource) Fetch(timeout time.Duration) (time.Time, error) {
+	return src.Clock.Now(), nil
+}
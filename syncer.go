@@ -0,0 +1,590 @@
+package gtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Syncer is a clock that is synced independently from the package functions,
+// which allows for multiple clocks that use different servers in the same
+// program. The package functions, such as Sync and Now, use a default
+// Syncer. Use New to create a Syncer.
+type Syncer struct {
+	cfg Config
+
+	mu     sync.RWMutex
+	synced bool          // time has been synced, a nanotime reading may be zero
+	ready  chan struct{} // closed when synced, see WaitSynced
+	nano   time.Duration
+	t      time.Time
+	offset time.Duration
+	rtt    time.Duration
+	last   time.Time
+	date   time.Time
+	err    time.Duration
+	status int
+	addr   string
+
+	// earlier sync that the drift is estimated from, see estimateDrift
+	prevSynced bool
+	prevNano   time.Duration
+	prevTime   time.Time
+	prevErr    time.Duration
+	drifted    bool    // drift has been estimated
+	drift      float64 // parts per million
+	correct    bool    // apply drift correction
+
+	smooth bool          // slew the offset, see SmoothOffset
+	alpha  float64       // weight of a new offset, see SetSmoothing
+	slew   time.Duration // correction that remains to be slewed at nano
+	mono   bool          // never go backwards, see Monotonic
+	local  bool          // use the local system time, see ForceLocal
+	utc    bool          // see KeepUTC
+
+	nopanic bool // return the local system time when unsynced
+
+	onsync  []func(offset time.Duration, serverTime time.Time)
+	onstep  []func(delta time.Duration)
+	step    time.Duration // threshold for onstep, see SetStepThreshold
+	maxSkew time.Duration
+	maxAge  time.Duration // see SetMaxAge
+
+	// decides whether the time of a sync is plausible, see SetValidator
+	valid func(serverTime, localTime time.Time) error
+
+	syncs uint64 // number of successful syncs
+	fails uint64 // number of failed syncs
+
+	snap     atomic.Pointer[snapshot]
+	monoLast atomic.Int64 // latest time returned in monotonic mode
+}
+
+// std is the Syncer that is used by the package functions.
+var std = New(Config{})
+
+// New returns a Syncer that fetches the time using the provided config, see
+// SyncConfig. The zero config fetches the time from Google over HTTP.
+func New(cfg Config) *Syncer {
+	return &Syncer{cfg: cfg, maxSkew: time.Hour * 24, step: time.Second * 2}
+}
+
+// Sync will sync the time using the config of the Syncer. If the operation
+// was successful then every following Now() call will return the synced
+// time.
+func (c *Syncer) Sync(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.SyncContext(ctx)
+}
+
+// SyncContext is like Sync but uses a context instead of a timeout.
+func (c *Syncer) SyncContext(ctx context.Context) error {
+	if c.forcedLocal() {
+		return nil
+	}
+	s, err := getNow(ctx, &c.cfg)
+	return c.commit(s, err)
+}
+
+// SetOffsetFromTime is like the SetOffsetFromTime package function but for
+// the Syncer.
+func (c *Syncer) SetOffsetFromTime(serverTime time.Time) error {
+	return c.store(sample{date: serverTime, t: serverTime, local: time.Now(),
+		nano: nanotime()})
+}
+
+// forcedLocal returns true when the local system time is forced, see
+// ForceLocal.
+func (c *Syncer) forcedLocal() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.local
+}
+
+// commit records the outcome of a sync. When err is nil the sample is
+// stored, see store.
+func (c *Syncer) commit(s sample, err error) error {
+	if c.forcedLocal() {
+		return nil
+	}
+	if err != nil {
+		logf("sync failed: %v", err)
+		c.mu.Lock()
+		c.fails++
+		c.mu.Unlock()
+		return err
+	}
+	return c.store(s)
+}
+
+// store makes the sample the time used by all following Now calls.
+// Returns an error if the sample is rejected.
+func (c *Syncer) store(s sample) error {
+	c.mu.RLock()
+	valid := c.valid
+	c.mu.RUnlock()
+	if valid != nil {
+		if err := valid(s.t, s.local); err != nil {
+			c.mu.Lock()
+			c.fails++
+			c.mu.Unlock()
+			logf("sync rejected: %v", err)
+			return fmt.Errorf("sync rejected: %w", err)
+		}
+	}
+	c.mu.Lock()
+	if c.maxSkew > 0 {
+		if offset := s.offset(); offset > c.maxSkew || offset < -c.maxSkew {
+			c.fails++
+			c.mu.Unlock()
+			logf("sync rejected: offset %v exceeds max skew", offset)
+			return fmt.Errorf("%w: offset is %v", ErrMaxSkew, offset)
+		}
+	}
+	if c.alpha > 0 && c.alpha < 1 && c.synced {
+		// exponentially weighted moving average of the offsets.
+		offset := c.alpha*float64(s.offset()) +
+			(1-c.alpha)*float64(c.offset)
+		s.t = s.local.Add(time.Duration(offset))
+	}
+	var slew time.Duration
+	prev, ok := c.snap.Load().timeAt(s.nano)
+	if ok && (c.smooth || c.mono && prev.After(s.t)) {
+		// keep the time continuous with the previous sync, slewing toward
+		// the new time.
+		slew = prev.Sub(s.t)
+	}
+	var onstep []func(delta time.Duration)
+	delta := s.offset() - c.offset
+	if c.synced && (delta > c.step || delta < -c.step) {
+		onstep = c.onstep
+	}
+	c.synced, c.t, c.nano, c.offset = true, s.t, s.nano, s.offset()
+	c.slew = slew
+	c.estimateDrift(s)
+	c.rtt, c.date, c.err, c.status = s.rtt, s.date, s.err, s.status
+	c.addr = s.addr
+	c.last = time.Now()
+	c.syncs++
+	if c.ready != nil {
+		close(c.ready)
+		c.ready = nil
+	}
+	c.publish()
+	onsync := c.onsync
+	c.mu.Unlock()
+	logf("synced: offset %v, rtt %v", s.offset(), s.rtt)
+	if ahead := -s.offset() - s.err; ahead > 0 {
+		logf("local clock is ahead by %v", ahead)
+	}
+	if len(onstep) > 0 {
+		logf("clock stepped by %v", delta)
+	}
+	for _, fn := range onstep {
+		fn(delta)
+	}
+	for _, fn := range onsync {
+		fn(s.offset(), s.t)
+	}
+	return nil
+}
+
+// estimateDrift estimates the drift between the earlier sync and the sample
+// that was just stored. The coarse times of Date headers would make the
+// estimate wildly off for syncs that are close together, so the earlier sync
+// is kept until enough time has elapsed for the uncertainty of both times to
+// be within the maximum drift. The lock must be held.
+func (c *Syncer) estimateDrift(s sample) {
+	if c.prevSynced {
+		elapsed := s.nano - c.prevNano
+		if elapsed <= 0 ||
+			float64(c.prevErr+s.err) > float64(elapsed)*maxDrift/1e6 {
+			return
+		}
+		c.drifted = true
+		c.drift = drift(c.prevTime, c.prevNano, s.t, s.nano)
+	}
+	c.prevSynced, c.prevTime, c.prevNano, c.prevErr = true, s.t, s.nano, s.err
+}
+
+// SetMaxSkew is like the SetMaxSkew package function but for the Syncer.
+func (c *Syncer) SetMaxSkew(max time.Duration) {
+	c.mu.Lock()
+	c.maxSkew = max
+	c.mu.Unlock()
+}
+
+// SetValidator is like the SetValidator package function but for the
+// Syncer.
+func (c *Syncer) SetValidator(fn func(serverTime, localTime time.Time) error) {
+	c.mu.Lock()
+	c.valid = fn
+	c.mu.Unlock()
+}
+
+// SetMaxAge is like the SetMaxAge package function but for the Syncer.
+func (c *Syncer) SetMaxAge(max time.Duration) {
+	c.mu.Lock()
+	c.maxAge = max
+	c.publish()
+	c.mu.Unlock()
+}
+
+// Reset clears the synced state, making it as if Sync has never been called.
+// Settings and the counters returned by Stats are not affected.
+func (c *Syncer) Reset() {
+	c.mu.Lock()
+	c.synced, c.nano, c.t, c.offset = false, 0, time.Time{}, 0
+	c.rtt, c.date, c.err, c.last = 0, time.Time{}, 0, time.Time{}
+	c.status, c.addr = 0, ""
+	c.prevSynced, c.prevNano, c.prevTime, c.prevErr = false, 0, time.Time{}, 0
+	c.drifted, c.drift = false, 0
+	c.slew = 0
+	c.publish()
+	c.mu.Unlock()
+}
+
+// WaitSynced is like the WaitSynced package function but for the Syncer.
+func (c *Syncer) WaitSynced(timeout time.Duration) error {
+	c.mu.Lock()
+	if c.synced {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	ready := c.ready
+	c.mu.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		return ErrNotSynced
+	}
+}
+
+// OnSync is like the OnSync package function but for the Syncer.
+func (c *Syncer) OnSync(fn func(offset time.Duration, serverTime time.Time)) {
+	c.mu.Lock()
+	// always copy, allowing for store to call the functions without holding
+	// the lock.
+	c.onsync = append(c.onsync[:len(c.onsync):len(c.onsync)], fn)
+	c.mu.Unlock()
+}
+
+// OnStep is like the OnStep package function but for the Syncer.
+func (c *Syncer) OnStep(fn func(delta time.Duration)) {
+	c.mu.Lock()
+	c.onstep = append(c.onstep[:len(c.onstep):len(c.onstep)], fn)
+	c.mu.Unlock()
+}
+
+// SetStepThreshold is like the SetStepThreshold package function but for the
+// Syncer.
+func (c *Syncer) SetStepThreshold(threshold time.Duration) {
+	c.mu.Lock()
+	c.step = threshold
+	c.mu.Unlock()
+}
+
+// Now returns the current synced time.
+// Panics with ErrNotSynced if Sync has not been succesfully called, or with
+// ErrStale if the last sync exceeds the max age, see PanicOnUnsynced.
+func (c *Syncer) Now() time.Time {
+	t, err := c.NowErr()
+	if err != nil {
+		return c.unsynced(err)
+	}
+	return t
+}
+
+// unsynced panics with the error, or returns the local system time when
+// panicking is turned off, see PanicOnUnsynced.
+func (c *Syncer) unsynced(err error) time.Time {
+	c.mu.RLock()
+	nopanic := c.nopanic
+	c.mu.RUnlock()
+	if nopanic {
+		return time.Now()
+	}
+	panic(err)
+}
+
+// PanicOnUnsynced is like the PanicOnUnsynced package function but for the
+// Syncer.
+func (c *Syncer) PanicOnUnsynced(enabled bool) {
+	c.mu.Lock()
+	c.nopanic = !enabled
+	c.mu.Unlock()
+}
+
+// NowErr returns the current synced time.
+// Returns ErrNotSynced if Sync has not been succesfully called, or ErrStale
+// if the last sync exceeds the max age, see SetMaxAge.
+func (c *Syncer) NowErr() (time.Time, error) {
+	t, _, err := c.nowAt(nanotime(), time.Now)
+	return t, err
+}
+
+// NowBoth returns the current synced time and the local system time, which
+// are captured at the same instant.
+// Panics with ErrNotSynced if Sync has not been succesfully called, see
+// PanicOnUnsynced.
+func (c *Syncer) NowBoth() (synced, local time.Time) {
+	// both clocks are read back-to-back.
+	nano, local := nanotime(), time.Now()
+	synced, _, err := c.nowAt(nano, func() time.Time { return local })
+	if err != nil {
+		return c.unsynced(err), local
+	}
+	return synced, local
+}
+
+// nowAt returns the synced time at the monotonic clock reading, or the local
+// system time that is returned by now when it's forced, see ForceLocal, in
+// which case local is true.
+func (c *Syncer) nowAt(nano time.Duration, now func() time.Time,
+) (t time.Time, local bool, err error) {
+	snap := c.snap.Load()
+	if snap != nil && snap.local {
+		// the local system time is returned as is, the other modes only
+		// apply to the synced time.
+		t = now()
+		if snap.utc {
+			t = t.UTC()
+		}
+		return t, true, nil
+	}
+	t, ok := snap.timeAt(nano)
+	if !ok {
+		return time.Time{}, false, ErrNotSynced
+	}
+	if snap.maxAge > 0 && nano-snap.nano > snap.maxAge {
+		return time.Time{}, false, ErrStale
+	}
+	if snap.mono {
+		t = c.monotonic(t)
+	}
+	if snap.utc {
+		return t.UTC(), false, nil
+	}
+	return t, false, nil
+}
+
+// slewRate is the rate at which SmoothOffset slews the time, which is the
+// same maximum rate that NTP uses, 500 parts per million.
+const slewRate = 500e-6
+
+// snapshot is a copy of the state that is used by NowErr. A new snapshot is
+// published whenever the state changes, allowing for NowErr to read the
+// state without taking the lock.
+type snapshot struct {
+	synced  bool
+	t       time.Time
+	unix    int64 // t in nanoseconds since the Unix epoch
+	nano    time.Duration
+	ppm     float64
+	correct bool
+	slew    time.Duration
+	utc     bool
+	mono    bool
+	local   bool
+	maxAge  time.Duration
+}
+
+// publish publishes a snapshot of the state. The lock must be held.
+func (c *Syncer) publish() {
+	c.snap.Store(&snapshot{synced: c.synced, t: c.t, unix: c.t.UnixNano(),
+		nano: c.nano, ppm: c.drift, correct: c.correct, slew: c.slew,
+		utc: c.utc, mono: c.mono, local: c.local, maxAge: c.maxAge})
+}
+
+// timeAt returns the synced time at the monotonic clock reading. Returns
+// false if not synced.
+func (snap *snapshot) timeAt(nano time.Duration) (time.Time, bool) {
+	if snap == nil || !snap.synced {
+		return time.Time{}, false
+	}
+	return snap.t.Add(snap.elapsed(nano)), true
+}
+
+// elapsed returns the synced time that elapsed between the sync and the
+// monotonic clock reading.
+func (snap *snapshot) elapsed(nano time.Duration) time.Duration {
+	elapsed := nano - snap.nano
+	if snap.correct {
+		elapsed += time.Duration(float64(elapsed) * snap.ppm / 1e6)
+	}
+	slew := snap.slew
+	if slew != 0 {
+		d := time.Duration(float64(max(elapsed, 0)) * slewRate)
+		if slew > 0 {
+			slew = max(slew-d, 0)
+		} else {
+			slew = min(slew+d, 0)
+		}
+	}
+	return elapsed + slew
+}
+
+// UnixNano returns the current synced time in nanoseconds since the Unix
+// epoch, like Now().UnixNano() but without computing the time.
+// Panics if Sync has not been succesfully called.
+func (c *Syncer) UnixNano() int64 {
+	snap := c.snap.Load()
+	if snap == nil || !snap.synced || snap.local || snap.mono ||
+		snap.maxAge > 0 {
+		return c.Now().UnixNano()
+	}
+	return snap.unix + int64(snap.elapsed(nanotime()))
+}
+
+// Unix returns the current synced time in seconds since the Unix epoch.
+// Panics if Sync has not been succesfully called.
+func (c *Syncer) Unix() int64 {
+	return c.UnixNano() / int64(time.Second)
+}
+
+// monotonic returns t, or the latest time returned in monotonic mode when t
+// is earlier.
+func (c *Syncer) monotonic(t time.Time) time.Time {
+	n := t.UnixNano()
+	for {
+		last := c.monoLast.Load()
+		if n <= last {
+			return t.Add(time.Duration(last - n))
+		}
+		if c.monoLast.CompareAndSwap(last, n) {
+			return t
+		}
+	}
+}
+
+// ForceLocal is like the ForceLocal package function but for the Syncer.
+func (c *Syncer) ForceLocal(local bool) {
+	c.mu.Lock()
+	c.local = local
+	c.publish()
+	c.mu.Unlock()
+}
+
+// Monotonic is like the Monotonic package function but for the Syncer.
+func (c *Syncer) Monotonic(mono bool) {
+	c.mu.Lock()
+	c.mono = mono
+	c.publish()
+	c.mu.Unlock()
+}
+
+// SmoothOffset is like the SmoothOffset package function but for the Syncer.
+func (c *Syncer) SmoothOffset(smooth bool) {
+	c.mu.Lock()
+	c.smooth = smooth
+	c.mu.Unlock()
+}
+
+// SetSmoothing is like the SetSmoothing package function but for the Syncer.
+func (c *Syncer) SetSmoothing(alpha float64) {
+	c.mu.Lock()
+	c.alpha = alpha
+	c.mu.Unlock()
+}
+
+// KeepUTC is like the KeepUTC package function but for the Syncer.
+func (c *Syncer) KeepUTC(keep bool) {
+	c.mu.Lock()
+	c.utc = keep
+	c.publish()
+	c.mu.Unlock()
+}
+
+// EnableDriftCorrection is like the EnableDriftCorrection package function
+// but for the Syncer.
+func (c *Syncer) EnableDriftCorrection(enabled bool) {
+	c.mu.Lock()
+	c.correct = enabled
+	c.publish()
+	c.mu.Unlock()
+}
+
+// IsSynced returns true if Sync has been succesfully called.
+func (c *Syncer) IsSynced() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.synced
+}
+
+// Offset returns the difference between the synced time and the local system
+// time as measured by the last successful Sync, see the Offset package
+// function.
+func (c *Syncer) Offset() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offset
+}
+
+// LastRTT returns the round-trip time of the request made by the last
+// successful Sync. Returns zero if time has not been synced.
+func (c *Syncer) LastRTT() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rtt
+}
+
+// LastStatus returns the HTTP status code of the response of the last
+// successful Sync. See the LastStatus function.
+func (c *Syncer) LastStatus() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// LastRemoteAddr returns the remote address of the connection of the last
+// successful Sync. See the LastRemoteAddr function.
+func (c *Syncer) LastRemoteAddr() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.addr
+}
+
+// LastSync returns the local system time of when the last successful Sync
+// completed. Returns false if time has not been synced.
+func (c *Syncer) LastSync() (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.last, c.synced
+}
+
+// Uncertainty returns the estimated maximum error of the time measured by
+// the last successful Sync, see the Uncertainty package function.
+func (c *Syncer) Uncertainty() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
+}
+
+// LastServerTime returns the time that was reported by the server during
+// the last successful Sync, prior to any adjustments.
+func (c *Syncer) LastServerTime() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.date
+}
+
+// Stats returns statistics about syncing since the Syncer was created.
+func (c *Syncer) Stats() SyncStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return SyncStats{
+		Synced:  c.syncs,
+		Failed:  c.fails,
+		LastRTT: c.rtt,
+		Offset:  c.offset,
+	}
+}